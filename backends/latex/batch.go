@@ -0,0 +1,194 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package latex
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/yzhs/alexandria/common"
+)
+
+// BatchRenderer is implemented by renderers that can render many scrolls at
+// once faster than one at a time.
+type BatchRenderer interface {
+	Renderer
+
+	// RenderBatch renders the given scrolls, returning the path of the
+	// image and the error for each of them, just like Render would.
+	RenderBatch(ctx context.Context, scrolls []common.Scroll) ([]string, []error)
+}
+
+// The name of the LaTeX file containing a batch of scrolls.  It does not look
+// like a UUID, so it cannot clash with the ID of a scroll.
+const batchName = "alexandria-batch"
+
+const (
+	beginDocument = `\begin{document}`
+	endDocument   = `\end{document}`
+)
+
+// Split the LaTeX file generated for a scroll into the preamble, the part of
+// the file producing the image of the scroll, and the end of the document.  If
+// the header and footer templates do not contain \begin{document} and
+// \end{document}, respectively, ok is false.
+func splitDocument(doc latexDocument) (preamble, page string, ok bool) {
+	i := strings.Index(doc.header, beginDocument)
+	j := strings.LastIndex(doc.footer, endDocument)
+	if i < 0 || j < 0 {
+		return "", "", false
+	}
+	i += len(beginDocument)
+	return doc.header[:i], doc.header[i:] + doc.body + doc.footer[:j], true
+}
+
+// RenderBatch compiles all the scrolls not found in the cache in a single TeX
+// run, producing one page per scroll, and converts each page to an image.
+// This saves starting TeX and loading the preamble for every scroll.  If the
+// batch cannot be compiled, e.g. because one of the scrolls contains an error,
+// each scroll is rendered on its own, so that the errors can be attributed to
+// the scrolls causing them.  The same happens for scrolls that cannot be
+// part of the batch because the templates produce a different preamble for
+// them.
+func (r *TexRenderer) RenderBatch(ctx context.Context, scrolls []common.Scroll) ([]string, []error) {
+	images := make([]string, len(scrolls))
+	errs := make([]error, len(scrolls))
+	renderAlone := func(i int) {
+		ctx, cancel := withRenderTimeout(ctx, r.library.Config().RenderTimeout, 1)
+		defer cancel()
+		images[i], errs[i] = r.Render(ctx, scrolls[i])
+	}
+
+	var batch []int
+	var preamble string
+	var pages []string
+	docs := make([]latexDocument, len(scrolls))
+	warnings := make([]error, len(scrolls))
+	for i, scroll := range scrolls {
+		var err error
+		docs[i], warnings[i], err = scrollToLatex(r.library, r.knownTypes, scroll)
+		if err != nil || r.isSettled(scroll.ID, docs[i]) {
+			// Render reports the error or finds the image or the
+			// failure in the cache, without running TeX.
+			renderAlone(i)
+			continue
+		}
+		p, page, ok := splitDocument(docs[i])
+		if !ok || (len(batch) > 0 && p != preamble) {
+			renderAlone(i)
+			continue
+		}
+		preamble = p
+		batch = append(batch, i)
+		pages = append(pages, `\begin{standalone}`+page+`\end{standalone}`+"\n")
+	}
+
+	if len(batch) == 1 {
+		renderAlone(batch[0])
+		return images, errs
+	} else if len(batch) == 0 {
+		return images, errs
+	}
+
+	if !r.compileBatch(ctx, batchPreamble(preamble), strings.Join(pages, ""), len(batch)) {
+		if ctx.Err() != nil {
+			for _, i := range batch {
+				errs[i] = r.contextError(ctx, scrolls[i].ID, common.StageLatex)
+			}
+			return images, errs
+		}
+		for _, i := range batch {
+			renderAlone(i)
+		}
+		return images, errs
+	}
+
+	for page, i := range batch {
+		id := scrolls[i].ID
+		r.library.ClearRenderedFiles(id, r.converter.extension)
+		err := r.pdfToImage(ctx, id, batchName, page+1, r.imagePath(id))
+		if err != nil {
+			common.LogError(err)
+			renderAlone(i)
+			continue
+		}
+		common.TryLogError(r.library.RecordCacheKey(id, r.cacheKey(docs[i])))
+		r.library.ClearFailure(id)
+		images[i], errs[i] = r.imagePath(id), warnings[i]
+	}
+	r.deleteTemporaryFiles(batchName)
+	return images, errs
+}
+
+// Modify the preamble of a scroll so that every scroll in a batch is put on a
+// page of its own.
+func batchPreamble(preamble string) string {
+	return `\PassOptionsToClass{multi}{standalone}` + "\n" + preamble
+}
+
+// Check whether the outcome of rendering the given scroll is known already,
+// i.e. it has been rendered to an image or failed to compile since it or the
+// templates last changed.  Such scrolls must not be part of a batch, as
+// compiling a scroll known to fail would make the whole batch fail.
+func (r *TexRenderer) isSettled(id common.ID, doc latexDocument) bool {
+	key := r.cacheKey(doc)
+	return r.library.IsCached(id, r.converter.extension, key) ||
+		r.library.RecordedFailure(id, key) != nil
+}
+
+// Compile a LaTeX file consisting of the given preamble and pages for the
+// given number of scrolls.  Any problem is logged, and the intermediate files
+// are kept for inspection.  If the PDF does not have exactly one page per
+// scroll, because some scroll spans several pages, the pages cannot be
+// matched to the scrolls, so that counts as a failure, too.
+func (r *TexRenderer) compileBatch(ctx context.Context, preamble, pages string, numScrolls int) bool {
+	ctx, cancel := withRenderTimeout(ctx, r.library.Config().RenderTimeout, numScrolls)
+	defer cancel()
+
+	doc := preamble + "\n" + pages + endDocument + "\n"
+	err := common.WriteTemp(r.tempDirectory, common.ID(batchName), doc)
+	if err != nil {
+		common.LogError(err)
+		return false
+	}
+	msg, err := r.compile(ctx, batchName, r.format(ctx, preamble))
+	if err != nil {
+		common.LogError("compiling a batch of scrolls failed, rendering them one by one: " + string(msg))
+		return false
+	}
+	if n := numPages(string(msg)); n != 0 && n != numScrolls {
+		common.LogError("a batch of " + strconv.Itoa(numScrolls) + " scrolls produced " +
+			strconv.Itoa(n) + " pages, rendering them one by one")
+		return false
+	}
+	return true
+}
+
+// renderBatch loads the scrolls with the given IDs and renders them all at
+// once using the given renderer.  The errors are returned in the same order
+// as the IDs.
+func (b LatexToPngBackend) renderBatch(ctx context.Context, ids []common.ID, renderer BatchRenderer) []error {
+	results := make([]error, len(ids))
+	var scrolls []common.Scroll
+	var indices []int
+	for i, id := range ids {
+		scroll, err := loadScroll(b.Library, id)
+		if err != nil {
+			results[i] = err
+			continue
+		}
+		scrolls = append(scrolls, scroll)
+		indices = append(indices, i)
+	}
+
+	_, errs := renderer.RenderBatch(ctx, scrolls)
+	for j, err := range errs {
+		logRenderError(err)
+		results[indices[j]] = err
+	}
+	return results
+}
@@ -0,0 +1,111 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package latex
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// A texEngine describes how to run one of the TeX engines.
+type texEngine struct {
+	// Produce the command line compiling the LaTeX file with the given
+	// name, without the .tex extension, in the current directory to a
+	// PDF file of the same name.  Unless format is empty, the
+	// precompiled format of that name is used.
+	command func(name, format string) []string
+
+	// Produce the command line dumping the preamble in the LaTeX file
+	// with the given name into a format of the same name, or nil if
+	// the engine cannot use precompiled formats.
+	dumpFormat func(name string) []string
+}
+
+// Create the command lines for one of the engines based on LaTeX.  Shell
+// escape is disabled and the first error aborts compilation rather than
+// waiting for input.
+func latexEngine(program string, formats bool) texEngine {
+	engine := texEngine{command: func(name, format string) []string {
+		command := []string{program, "-no-shell-escape", "-halt-on-error"}
+		if format != "" {
+			command = append(command, "-fmt="+format)
+		}
+		return append(command, name)
+	}}
+	if formats {
+		// mylatexformat dumps everything up to \begin{document}, and
+		// makes the format skip the preamble of the documents
+		// compiled with it.
+		engine.dumpFormat = func(name string) []string {
+			return []string{program, "-ini", "-no-shell-escape", "-halt-on-error",
+				"-jobname=" + name, "&" + program, "mylatexformat.ltx", name + ".tex"}
+		}
+	}
+	return engine
+}
+
+// The TeX engines Config.Renderer can be set to.  The configuration only
+// accepts the names listed in common's renderers.  LuaLaTeX cannot store the
+// state of Lua, e.g. the fonts loaded by luaotfload, in a format.
+var engines = map[string]texEngine{
+	"xelatex":  latexEngine("xelatex", true),
+	"pdflatex": latexEngine("pdflatex", true),
+	"lualatex": latexEngine("lualatex", false),
+	"tectonic": {command: func(name, format string) []string {
+		return []string{"tectonic", "--untrusted", "--chatter", "minimal", name + ".tex"}
+	}},
+}
+
+// IsTexInstalled checks whether the TeX engine with the given name, usually
+// Config.Renderer, can be found in the PATH.  If it cannot, LatexToPngBackend
+// is of no use and LatexToHTMLBackend should be used instead.
+func IsTexInstalled(name string) bool {
+	engine, ok := engines[name]
+	if !ok {
+		return false
+	}
+	_, err := exec.LookPath(engine.command("", "")[0])
+	return err == nil
+}
+
+// An imageConverter turns the PDF file produced by TeX into an image.
+type imageConverter struct {
+	// The extension of the images
+	extension string
+	// Produce the command line converting the given page of the PDF file
+	// to the given image.  Page 0 stands for the only page of a PDF.
+	command func(pdf string, page int, image string) []string
+}
+
+// Use ImageMagick to create PNG files with the given quality and resolution.
+func imagemagick(quality, dpi int) imageConverter {
+	return imageConverter{
+		extension: ".png",
+		command: func(pdf string, page int, image string) []string {
+			if page > 0 {
+				// ImageMagick counts pages starting from 0.
+				pdf += "[" + strconv.Itoa(page-1) + "]"
+			}
+			return []string{"convert", "-trim",
+				"-quality", strconv.Itoa(quality),
+				"-density", strconv.Itoa(dpi),
+				pdf, image}
+		},
+	}
+}
+
+// Use dvisvgm to create SVG files, which, unlike PNGs, look sharp at any
+// resolution.
+var dvisvgm = imageConverter{
+	extension: ".svg",
+	command: func(pdf string, page int, image string) []string {
+		command := []string{"dvisvgm", "--pdf", "--no-fonts", "--exact-bbox"}
+		if page > 0 {
+			command = append(command, "--page="+strconv.Itoa(page))
+		}
+		return append(command, "--output="+image, pdf)
+	},
+}
@@ -0,0 +1,122 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package latex
+
+import (
+	"context"
+	"os"
+
+	"github.com/yzhs/alexandria/common"
+)
+
+// The prefix of the names of the precompiled formats
+const formatPrefix = "preamble-"
+
+// Find or build a precompiled format containing the given preamble, so that
+// TeX does not have to load all the packages again for every scroll.  The
+// name of the format is derived from the preamble, so a new format is built
+// whenever the header template changes.  The formats are kept in the format
+// directory and linked into the temp directory of the renderer, as TeX only
+// reads files from the directory it runs in.  If the engine does not support
+// formats, or the format cannot be built, the empty string is returned and
+// the preamble is processed as usual.
+func (r *TexRenderer) format(ctx context.Context, preamble string) string {
+	if r.engine.dumpFormat == nil {
+		return ""
+	}
+	name := formatName(r.engine, preamble)
+	if _, err := os.Stat(r.formatDirectory + name + ".fmt"); err != nil {
+		if r.failedFormats[name] || !r.buildFormat(ctx, name, preamble) {
+			return ""
+		}
+	}
+
+	err := os.Link(r.formatDirectory+name+".fmt", r.tempDirectory+name+".fmt")
+	if err != nil && !os.IsExist(err) {
+		common.LogError(err)
+		return ""
+	}
+	return name
+}
+
+// The name of the format the given engine builds from the given preamble
+func formatName(engine texEngine, preamble string) string {
+	return formatPrefix + common.CacheKey(append(engine.dumpFormat(""), preamble)...)[:16]
+}
+
+// FormatsInUse lists the formats the scrolls of the library are rendered
+// with, given the current templates, both on their own and in a batch.  The
+// garbage collector keeps these and deletes the other formats.
+func (b LatexToPngBackend) FormatsInUse() ([]string, error) {
+	engine, ok := engines[b.Library.Config().Renderer]
+	if !ok || engine.dumpFormat == nil {
+		return nil, nil
+	}
+	ids, err := b.Library.ScrollIDs(".tex")
+	if err != nil {
+		return nil, err
+	}
+	knownTypes := b.Library.KnownTypes()
+	inUse := make(map[string]bool)
+	for _, id := range ids {
+		doc, err := b.Library.ReadScroll(id)
+		if err != nil {
+			continue
+		}
+		latex, _, err := scrollToLatex(b.Library, knownTypes, parse(b.Library, string(id), doc))
+		if err != nil {
+			continue
+		}
+		preamble, _, ok := splitDocument(latex)
+		if !ok {
+			continue
+		}
+		inUse[formatName(engine, preamble)+".fmt"] = true
+		inUse[formatName(engine, batchPreamble(preamble))+".fmt"] = true
+	}
+
+	var names []string
+	for name := range inUse {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Build the format with the given name and move it to the format directory.
+// The format is dumped in the temp directory of the renderer, which no other
+// render uses, and only moved once TeX has finished writing it, so other
+// renders never load a format that is incomplete, e.g. because TeX was
+// killed or is still running.
+func (r *TexRenderer) buildFormat(ctx context.Context, name, preamble string) bool {
+	err := common.WriteTemp(r.tempDirectory, common.ID(name), preamble+"\n"+endDocument+"\n")
+	if err != nil {
+		common.LogError(err)
+		return false
+	}
+	msg, err := r.run(ctx, r.engine.dumpFormat(name))
+	if err != nil {
+		if ctx.Err() == nil {
+			common.LogError("building the format " + name + " failed, compiling without it: " + string(msg))
+			r.failedFormats[name] = true
+		}
+		return false
+	}
+
+	err = os.MkdirAll(r.formatDirectory, 0755)
+	if err == nil {
+		// Renaming is atomic, so another render building the same
+		// format at the same time does no harm.
+		err = os.Rename(r.tempDirectory+name+".fmt", r.formatDirectory+name+".fmt")
+	}
+	if err != nil {
+		common.LogError(err)
+		return false
+	}
+	for _, extension := range []string{".tex", ".log"} {
+		common.TryLogError(os.Remove(r.tempDirectory + name + extension))
+	}
+	return true
+}
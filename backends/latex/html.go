@@ -0,0 +1,229 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package latex
+
+import (
+	"context"
+	"html"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/yzhs/alexandria/common"
+)
+
+// LatexToHTMLBackend renders LaTeX scrolls to HTML without running TeX.  Only
+// the text is converted, the maths is left untouched for KaTeX or MathJax to
+// typeset in the browser.
+type LatexToHTMLBackend struct {
+	// The library the scrolls belong to
+	Library *common.Library
+}
+
+func (b LatexToHTMLBackend) RenderAllScrolls(ctx context.Context) (numScrolls int, errors []error) {
+	ids, err := b.Library.ScrollIDs(".tex")
+	if err != nil {
+		return 0, []error{err}
+	}
+	renderedIDs, errors := b.RenderScrollsByID(ctx, ids)
+	return len(renderedIDs), errors
+}
+
+func (b LatexToHTMLBackend) RenderScrollsByID(ctx context.Context, ids []common.ID) (renderedScrollIDs []common.ID, errors []error) {
+	knownTypes := b.Library.KnownTypes()
+	return common.RenderOneByOne(ctx, ids, func(id common.ID) error {
+		return b.renderScrollToHTML(id, knownTypes)
+	})
+}
+
+func (b LatexToHTMLBackend) Parse(id, doc string) common.Scroll {
+	return parse(b.Library, id, doc)
+}
+
+// htmlConverterVersion has to be incremented whenever the output of latexToHTML
+// changes, so that scrolls rendered by an older version are not reused.
+const htmlConverterVersion = 1
+
+// renderScrollToHTML converts the LaTeX scroll with the given ID to HTML and
+// stores the result in the cache directory.  If the scroll was rendered
+// despite some problem, a RenderWarning is returned, otherwise any problem is
+// reported as a RenderError.
+func (b LatexToHTMLBackend) renderScrollToHTML(id common.ID, knownTypes map[string]bool) error {
+	l := b.Library
+	doc, err := l.ReadScrollToRender(id)
+	if err != nil {
+		return err
+	}
+	scroll := parse(l, string(id), doc)
+	scrollType, warning := templateType(knownTypes, id, scroll.Type)
+	header, _ := l.ReadTemplate(scrollType + "_header")
+	key := common.CacheKey("latex-html", strconv.Itoa(htmlConverterVersion), doc, header)
+	if l.IsCached(id, ".html", key) {
+		return warning
+	}
+
+	result := wrapInTypeBlock(l, scrollType, scroll, latexToHTML(scroll.Content))
+	err = ioutil.WriteFile(l.CacheFile(id, ".html"), []byte(result), 0644)
+	if err != nil {
+		err = errors.Wrapf(err, "write %v.html to cache directory", id)
+		return &common.RenderError{ID: id, Stage: common.StageConvert, Err: err}
+	}
+	common.TryLogError(l.RecordCacheKey(id, key))
+	return warning
+}
+
+var (
+	beginEnvironmentPattern = regexp.MustCompile(`\\begin\{([a-zA-Z]+)\*?\}(\[[^\]]*\])?`)
+	endEnvironmentPattern   = regexp.MustCompile(`\\end\{([a-zA-Z]+)\*?\}`)
+	itemPattern             = regexp.MustCompile(`\\item(\[[^\]]*\])?\s*`)
+	commentLinePattern      = regexp.MustCompile(`(?m)^[ \t]*%.*(\n|$)`)
+	commentPattern          = regexp.MustCompile(`([^\\])%.*`)
+
+	// Commands taking a single argument, which are translated into the
+	// corresponding HTML elements.
+	textCommands = map[string]string{
+		"emph":      "em",
+		"textit":    "em",
+		"textbf":    "strong",
+		"texttt":    "code",
+		"underline": "u",
+		"textsc":    "span class=\"smallcaps\"",
+	}
+	textCommandPattern = regexp.MustCompile(`\\(emph|textit|textbf|texttt|underline|textsc)\{([^{}]*)\}`)
+
+	// Environments translated to lists rather than to blocks
+	listEnvironments = map[string]string{
+		"itemize":     "ul",
+		"enumerate":   "ol",
+		"description": "ul",
+	}
+
+	// Simple replacements applied to the text outside of maths
+	textReplacements = strings.NewReplacer(
+		"---", "—",
+		"--", "–",
+		"``", "“",
+		"&#39;&#39;", "”",
+		"~", "&nbsp;",
+		`\\`, "<br>",
+		`\ `, " ",
+		`\,`, "&thinsp;",
+		`\%`, "%",
+		`\&amp;`, "&amp;",
+		`\$`, "$",
+		`\#`, "#",
+		`\_`, "_",
+		`\{`, "{",
+		`\}`, "}",
+		`\LaTeX`, "LaTeX",
+		`\TeX`, "TeX",
+		`\ldots`, "…",
+		`\dots`, "…",
+		`\noindent`, "",
+	)
+)
+
+// Make a LaTeX environment name presentable, e.g. "theorem" -> "Theorem".
+func environmentTitle(name string) string {
+	if name == "" {
+		return ""
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// Translate the beginning of a LaTeX environment to HTML.  Lists become lists,
+// all other environments become blocks like the ones for the scroll types.
+func beginEnvironment(match string) string {
+	groups := beginEnvironmentPattern.FindStringSubmatch(match)
+	name, optional := groups[1], strings.Trim(groups[2], "[]")
+	if tag, ok := listEnvironments[name]; ok {
+		return "<" + tag + ">"
+	}
+	return blockHeader(name, optional)
+}
+
+func endEnvironment(match string) string {
+	name := endEnvironmentPattern.FindStringSubmatch(match)[1]
+	if tag, ok := listEnvironments[name]; ok {
+		return "</" + tag + ">"
+	}
+	return "</div>"
+}
+
+// Produce the opening tag and title of a block for a theorem-like
+// environment.  If an optional argument was given, e.g. a reference for a
+// theorem, it is shown in parentheses after the title.
+func blockHeader(name, optional string) string {
+	result := `<div class="block block-` + name + `"><span class="block-title">` + environmentTitle(name)
+	if optional != "" {
+		result += " (" + optional + ")"
+	}
+	return result + ".</span> "
+}
+
+// latexToHTML converts the text of a LaTeX scroll into an HTML fragment.  Only
+// the most common text mode commands and environments are supported.
+func latexToHTML(content string) string {
+	content = commentLinePattern.ReplaceAllString(content, "")
+	content = commentPattern.ReplaceAllString(content, "$1")
+	protected, formulae := common.ProtectMath(content)
+	text := html.EscapeString(protected)
+
+	for {
+		replaced := textCommandPattern.ReplaceAllStringFunc(text, func(match string) string {
+			groups := textCommandPattern.FindStringSubmatch(match)
+			tag := textCommands[groups[1]]
+			closingTag := strings.Fields(tag)[0]
+			return "<" + tag + ">" + groups[2] + "</" + closingTag + ">"
+		})
+		if replaced == text {
+			break
+		}
+		text = replaced
+	}
+
+	text = beginEnvironmentPattern.ReplaceAllStringFunc(text, beginEnvironment)
+	text = endEnvironmentPattern.ReplaceAllStringFunc(text, endEnvironment)
+	text = itemPattern.ReplaceAllStringFunc(text, func(match string) string {
+		label := strings.Trim(itemPattern.FindStringSubmatch(match)[1], "[]")
+		if label != "" {
+			return "<li><strong>" + label + "</strong> "
+		}
+		return "<li>"
+	})
+	text = textReplacements.Replace(text)
+
+	var paragraphs []string
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph != "" {
+			paragraphs = append(paragraphs, "<p>"+paragraph+"</p>")
+		}
+	}
+	return common.RestoreMath(strings.Join(paragraphs, "\n"), formulae)
+}
+
+// Wrap the HTML of a scroll in the block corresponding to the environment its
+// type template uses, e.g. a theorem block for scrolls of type theorem.  The
+// optional argument of the environment, if the template passes one, is shown
+// in the block's title.  If the template does not use an environment, the HTML
+// is returned unchanged.
+func wrapInTypeBlock(l *common.Library, scrollType string, scroll common.Scroll, content string) string {
+	header, err := readAndExecuteTemplate(l, scrollType+"_header", scroll)
+	if err != nil {
+		common.LogError(err)
+		return content
+	}
+	groups := beginEnvironmentPattern.FindStringSubmatch(header)
+	if groups == nil {
+		return content
+	}
+	optional := latexUnescaper.Replace(strings.Trim(groups[2], "[]{}"))
+	return blockHeader(groups[1], html.EscapeString(optional)) + content + "</div>"
+}
@@ -9,9 +9,10 @@
 package latex
 
 import (
-	"fmt"
-	"io/ioutil"
-	"strings"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/yzhs/alexandria/common"
 )
@@ -19,46 +20,177 @@ import (
 type ID = common.ID
 
 type LatexToPngBackend struct {
-	Renderer latexToPngRenderer
+	// The library the scrolls belong to
+	Library *common.Library
+	// NewRenderer creates a renderer for the given library storing its
+	// intermediate files in the given directory and using the fallback
+	// templates for scrolls of a type not among the known types.  Each of
+	// the up to Config.MaxProcs parallel workers gets a renderer of its
+	// own.
+	NewRenderer func(l *common.Library, tempDirectory string, knownTypes map[string]bool) (Renderer, error)
 }
 
-func (b LatexToPngBackend) RenderAllScrolls() (numScrolls int, errors []error) {
-	ids := b.IDsForAllScrolls()
-	renderedIDs, errors := b.RenderScrollsByID(ids)
+// The maximal number of scrolls compiled in a single TeX run when rendering
+// all scrolls
+const batchSize = 32
+
+// RenderAllScrolls renders all LaTeX scrolls.  If the renderer supports it,
+// scrolls are compiled in batches to avoid starting TeX for every one of them.
+func (b LatexToPngBackend) RenderAllScrolls(ctx context.Context) (numScrolls int, errors []error) {
+	ids, err := b.Library.ScrollIDs(".tex")
+	if err != nil {
+		return 0, []error{err}
+	}
+	renderedIDs, errors := b.render(ctx, ids, batchSize)
 	return len(renderedIDs), errors
 }
 
-func (b LatexToPngBackend) RenderScrollsByID(ids []common.ID) (renderedScrollIDs []common.ID, errors []error) {
-	renderedScrollIDs = make([]common.ID, len(ids))
-	numScrolls := 0
-	for _, id := range ids {
-		err := renderScroll(id, b.Renderer)
+// RenderScrollsByID renders the given scrolls using up to Config.MaxProcs
+// workers in parallel.  The rendered IDs and the errors are returned in the
+// same order as the IDs passed in, regardless of the order in which the
+// workers finish.  Scrolls rendered despite a warning are included in the
+// rendered IDs, and the warning among the errors.  Each scroll may take up to
+// Config.RenderTimeout to render.
+func (b LatexToPngBackend) RenderScrollsByID(ctx context.Context, ids []common.ID) (renderedScrollIDs []common.ID, errs []error) {
+	return b.render(ctx, ids, 1)
+}
+
+// Render the given scrolls, passing up to maxBatchSize of them to a worker at
+// a time.
+func (b LatexToPngBackend) render(ctx context.Context, ids []common.ID, maxBatchSize int) (renderedScrollIDs []common.ID, errs []error) {
+	results := make([]error, len(ids))
+	jobs := make(chan []int)
+	var wg sync.WaitGroup
+
+	var err error
+	knownTypes := b.Library.KnownTypes()
+	workers := 0
+	for workers < b.numWorkers(len(ids)) {
+		var renderer Renderer
+		var dir string
+		renderer, dir, err = b.newWorkerRenderer(knownTypes)
 		if err != nil {
-			errors = append(errors, fmt.Errorf("rendering %v failed", id))
-		} else {
-			renderedScrollIDs[numScrolls] = id
-			numScrolls++
+			// Make do with the workers we already have.
+			common.LogError(err)
+			break
+		}
+		defer removeWorkDirectory(dir)
+		workers++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				b.renderJob(ctx, ids, job, renderer, results)
+			}
+		}()
+	}
+
+	size := 1
+	if workers > 0 {
+		size = batchSizeFor(len(ids), workers, maxBatchSize)
+	}
+	for start := 0; start < len(ids); start += size {
+		end := start + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if workers == 0 {
+			for i := start; i < end; i++ {
+				results[i] = err
+			}
+			continue
+		}
+		job := make([]int, 0, end-start)
+		for i := start; i < end; i++ {
+			job = append(job, i)
+		}
+		jobs <- job
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, id := range ids {
+		if results[i] != nil {
+			errs = append(errs, results[i])
+		}
+		if results[i] == nil || common.IsRenderWarning(results[i]) {
+			renderedScrollIDs = append(renderedScrollIDs, id)
+		}
+	}
+	return renderedScrollIDs, errs
+}
+
+// Render the scrolls whose indices are given, as a batch if the renderer
+// supports it, storing the errors at the same indices in results.
+func (b LatexToPngBackend) renderJob(ctx context.Context, ids []common.ID, job []int, renderer Renderer, results []error) {
+	batchRenderer, ok := renderer.(BatchRenderer)
+	if !ok || len(job) == 1 {
+		for _, i := range job {
+			results[i] = b.renderScroll(ctx, ids[i], renderer)
 		}
+		return
+	}
+
+	batchIDs := make([]common.ID, len(job))
+	for j, i := range job {
+		batchIDs[j] = ids[i]
+	}
+	for j, err := range b.renderBatch(ctx, batchIDs, batchRenderer) {
+		results[job[j]] = err
+	}
+}
+
+// Determine how many scrolls to put into each batch, such that all the
+// workers have something to do.
+func batchSizeFor(numScrolls, numWorkers, maxBatchSize int) int {
+	size := (numScrolls + numWorkers - 1) / numWorkers
+	if size > maxBatchSize {
+		size = maxBatchSize
 	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
 
-	return renderedScrollIDs[:numScrolls], errors
+// Determine how many workers to use for rendering the given number of
+// scrolls.
+func (b LatexToPngBackend) numWorkers(numScrolls int) int {
+	n := b.Library.Config().MaxProcs
+	if n < 1 {
+		n = 1
+	}
+	if numScrolls < n {
+		n = numScrolls
+	}
+	return n
 }
 
-// IDsForAllScrolls goes through the library directory and creates a list of
-// the IDs of all available LaTeX scrolls.
-func (LatexToPngBackend) IDsForAllScrolls() []ID {
-	files, err := ioutil.ReadDir(common.Config.KnowledgeDirectory)
+// Create a renderer for a worker, working in a new directory of its own so
+// that parallel TeX runs do not interfere.  The directory is returned, too, so
+// it can be removed once the worker is done.
+func (b LatexToPngBackend) newWorkerRenderer(knownTypes map[string]bool) (Renderer, string, error) {
+	dir, err := b.Library.NewWorkDirectory()
 	if err != nil {
-		panic(err)
+		return nil, "", err
 	}
+	renderer, err := b.NewRenderer(b.Library, dir, knownTypes)
+	if err != nil {
+		removeWorkDirectory(dir)
+		return nil, "", err
+	}
+	return renderer, dir, nil
+}
 
-	var ids []ID
-	for _, file := range files {
-		if !strings.HasSuffix(file.Name(), ".tex") {
-			continue
-		}
-		id := ID(strings.TrimSuffix(file.Name(), ".tex"))
-		ids = append(ids, id)
+// Remove the work directory of a worker, unless it still contains the
+// intermediate files of a failed render, which are kept for inspection until
+// CollectGarbage deletes them.
+func removeWorkDirectory(dir string) {
+	links, err := filepath.Glob(dir + formatPrefix + "*.fmt")
+	common.TryLogError(err)
+	for _, link := range links {
+		common.TryLogError(os.Remove(link))
 	}
-	return ids
+	// This fails if there are files left.
+	_ = os.Remove(dir)
 }
@@ -37,19 +37,6 @@ func findMetadataLines(doc string) []string {
 	return metadata
 }
 
-// Parse a comma separated list of tags into a slice, tranfsorming everything
-// to lower case.
-func parseTags(line string) []string {
-	var tags []string
-	for _, tag := range strings.Split(line, ",") {
-		tmp := strings.TrimSpace(tag)
-		if tmp != "" {
-			tags = append(tags, tmp)
-		}
-	}
-	return tags
-}
-
 // Parse the tags in the given scroll content.  The format of a scroll is
 // generally of the following form:
 //
@@ -64,59 +51,44 @@ func parseTags(line string) []string {
 // 'counter-example', 'analysis', 'topology' and 'weierstraß'.  It can be found
 // in Author: Title as Lemma 3.2 on pase 41.  All the metadata is stored in the
 // final block of LaTeX comments.  Also, we simply ignore any empty lines.
-func parse(id, doc string) common.Scroll {
-	// TODO Handle different types of tags: @source, @doctype, @keywords, and normal tags.
-	var source []string
-	var hidden []string
-	var scrollType string
-	var tags []string
-	var otherLines []string
-
-	for _, line := range findMetadataLines(doc) {
-		switch {
-		case strings.HasPrefix(line, "@hidden "):
-			hidden = append(hidden, parseTags(strings.TrimPrefix(line, "@hidden "))...)
-		case strings.HasPrefix(line, "@source "):
-			source = append(source, strings.TrimSpace(strings.TrimPrefix(line, "@source ")))
-		case strings.HasPrefix(line, "@type "):
-			tmp := strings.TrimSpace(strings.TrimPrefix(line, "@type "))
-			for _, typ := range strings.Split(tmp, ",") {
-				// Ignore all but the first type, the other
-				// ones are just for searching
-				if scrollType == "" {
-					scrollType = strings.TrimSpace(typ)
-					break
-				}
-			}
-		case strings.HasPrefix(line, "@"):
-			// Do not strip the @[a-zA-Z0-9\-]** prefix, otherwise
-			// there is no way to tell what the line signifies.
-			otherLines = append(otherLines, line)
-		default:
-			tags = append(tags, parseTags(line)...)
-		}
-	}
-	content := stripComments(doc)
-
-	return common.Scroll{ID: common.ID(id), Content: content, Type: scrollType,
-		SourceLines: source, Tags: tags, Hidden: hidden,
-		OtherLines: otherLines}
+func parse(l *common.Library, id, doc string) common.Scroll {
+	content, lines := stripComments(doc)
+	scroll := l.ParseMetadata(common.ID(id), content, findMetadataLines(doc))
+	scroll.ContentLines = lines
+	return scroll
 }
 
-func (LatexToPngBackend) Parse(id, doc string) common.Scroll {
-	return parse(id, doc)
+func (b LatexToPngBackend) Parse(id, doc string) common.Scroll {
+	return parse(b.Library, id, doc)
 }
 
 // Remove all lines that only contain a LaTeX comment.  This removes all the
-// medatata from a scroll.
-func stripComments(doc string) string {
+// medatata from a scroll.  For each line of the result, the number of the
+// line of doc it comes from is returned as well.
+func stripComments(doc string) (string, []int) {
 	var content string
+	var lines []int
+	// The line of doc the current paragraph starts in
+	start := 1
 	for _, line := range strings.Split(doc, "\n\n") {
 		trimmedLine := strings.TrimSpace(line)
+		first := start + strings.Count(line[:strings.Index(line, trimmedLine)], "\n")
+		start += strings.Count(line, "\n") + 2
 		if len(trimmedLine) > 0 && trimmedLine[0] == '%' {
 			continue
 		}
 		content += trimmedLine + "\n\n"
+		// The lines of the paragraph and the empty line following it
+		for i := 0; i <= strings.Count(trimmedLine, "\n")+1; i++ {
+			lines = append(lines, first+i)
+		}
+	}
+
+	result := strings.TrimSpace(content)
+	if result == "" {
+		return "", nil
 	}
-	return strings.TrimSpace(content)
+	// Drop the lines removed along with the surrounding whitespace.
+	lines = lines[strings.Count(content[:strings.Index(content, result)], "\n"):]
+	return result, lines[:strings.Count(result, "\n")+1]
 }
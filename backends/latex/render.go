@@ -6,151 +6,438 @@
 package latex
 
 import (
+	"context"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/yzhs/alexandria/common"
 )
 
-// errNoSuchScroll is used when a query returns a scroll ID that is no longer
-// in the library, i.e. has been deleted but RemoveFromIndex has not yet been
-// called on it.
-var errNoSuchScroll = errors.New("No such scroll")
+// Renderer turns LaTeX scrolls into images.
+//
+// Render stores the image in the cache directory and returns its path.  If
+// the scroll was rendered despite some problem, both the path and a
+// RenderWarning are returned.  If it could not be rendered, the error is
+// usually a RenderError.  Render must give up when the context expires.
+//
+// Renderers used by LatexToPngBackend do not have to be safe for concurrent
+// use, as each worker gets a renderer of its own.
+type Renderer interface {
+	Render(ctx context.Context, scroll common.Scroll) (string, error)
+}
 
-type errTemplateReader struct {
-	doc string
-	err error
+// TexRenderer compiles scrolls using one of the TeX engines listed in engines,
+// and converts the resulting PDF to an image in the format selected by
+// Config.ImageFormat.
+type TexRenderer struct {
+	library   *common.Library
+	engine    texEngine
+	converter imageConverter
+
+	// The directory holding all the intermediate files.  Renderers
+	// running in parallel must not share a temp directory.
+	tempDirectory string
+	// The directory holding the precompiled formats, which is shared
+	// by all renderers
+	formatDirectory string
+
+	// The formats that could not be built, so building them is not
+	// attempted again for every scroll
+	failedFormats map[string]bool
+
+	// The scroll types there are templates for, see
+	// common.Library.KnownTypes
+	knownTypes map[string]bool
 }
 
-// Load a template file from disk and propagate errors
-func (e *errTemplateReader) readTemplate(name string) {
-	if e.err != nil {
-		return
+// NewTexRenderer creates a renderer for the scrolls of the given library using
+// the TeX engine with the given name, e.g. "xelatex", and storing its
+// intermediate files in the given directory.  Scrolls of a type not among the
+// known types are rendered using the fallback templates.
+func NewTexRenderer(l *common.Library, engine, tempDirectory string, knownTypes map[string]bool) (*TexRenderer, error) {
+	e, ok := engines[engine]
+	if !ok {
+		return nil, errors.Errorf("unknown TeX engine '%v'", engine)
+	}
+	config := l.Config()
+	converter := imagemagick(config.Quality, config.Dpi)
+	if config.ImageFormat == "svg" {
+		converter = dvisvgm
 	}
+	return &TexRenderer{library: l, engine: e, converter: converter,
+		tempDirectory: tempDirectory, formatDirectory: l.FormatDirectory(),
+		failedFormats: make(map[string]bool), knownTypes: knownTypes}, nil
+}
 
-	tmp, err := common.ReadTemplate(name)
-	e.err = errors.Wrapf(err, "read template %v", name)
-	e.doc += tmp
+// NewRenderer creates the renderer selected by the library's Config.Renderer,
+// storing its intermediate files in the given directory.
+func NewRenderer(l *common.Library, tempDirectory string, knownTypes map[string]bool) (Renderer, error) {
+	return NewTexRenderer(l, l.Config().Renderer, tempDirectory, knownTypes)
 }
 
-// latexToPngRenderer describes a LaTeX->PDF->PNG pipeline.
-type latexToPngRenderer interface {
-	// Create a LaTeX file from the content of the given scroll together
-	// with all the appropriate templates.  The resulting file stored in
-	// the temp directory.
-	scrollToLatex(id common.ID)
+// Render creates a LaTeX file from the scroll and the appropriate templates,
+// compiles it and converts the result to an image.  If the scroll spans
+// several pages, each page is converted to an image of its own, and the path
+// of the first one is returned.  Nothing is compiled if the images in the
+// cache were created from the same LaTeX file with the same settings.
+func (r *TexRenderer) Render(ctx context.Context, scroll common.Scroll) (string, error) {
+	id := scroll.ID
+	doc, warning, err := scrollToLatex(r.library, r.knownTypes, scroll)
+	if err != nil {
+		return "", &common.RenderError{ID: id, Stage: common.StageTemplate, Err: err}
+	}
 
-	// Compile a LaTeX file with the given id to produce a PDF file.  Both
-	// input and output files are in the temp directory.
-	latexToPdf(id common.ID)
+	key := r.cacheKey(doc)
+	if r.library.IsCached(id, r.converter.extension, key) {
+		return r.firstImage(id), warning
+	}
+	if failure := r.library.RecordedFailure(id, key); failure != nil {
+		// Compiling the same file again would fail the same way.
+		return "", failure
+	}
 
-	// Convert PDF to PNG, storing the result in the cache directory.  From
-	// there, it can be served by the web server or displayed to the user
-	// via some other user interface.
-	pdfToPng(id common.ID)
+	err = common.WriteTemp(r.tempDirectory, id, doc.String())
+	if err != nil {
+		return "", &common.RenderError{ID: id, Stage: common.StageTemplate, Err: err}
+	}
+	pages, err := r.latexToPdf(ctx, id, doc)
+	if err != nil {
+		r.recordFailure(key, err)
+		return "", err
+	}
+	r.library.ClearRenderedFiles(id, r.converter.extension)
+	if pages <= 1 {
+		err = r.pdfToImage(ctx, id, string(id), 0, r.imagePath(id))
+	}
+	for page := 0; page < pages && pages > 1 && err == nil; page++ {
+		err = r.pdfToImage(ctx, id, string(id), page+1, r.library.PageFile(id, page, r.converter.extension))
+	}
+	if err != nil {
+		r.recordFailure(key, err)
+		return "", err
+	}
 
-	deleteTemporaryFiles(id common.ID)
+	// Intermediate files are only deleted on success, so they can be
+	// inspected when something goes wrong.
+	r.deleteTemporaryFiles(string(id))
+	common.TryLogError(r.library.RecordCacheKey(id, key))
+	r.library.ClearFailure(id)
+	return r.firstImage(id), warning
+}
 
-	err() error
+// Remember why compiling the LaTeX file with the given cache key failed.
+func (r *TexRenderer) recordFailure(key string, err error) {
+	if renderError, ok := err.(*common.RenderError); ok {
+		common.TryLogError(r.library.RecordFailure(key, renderError))
+	}
 }
 
-// XelatexImagemagickRenderer uses xelatex to handle the LaTeX-to-PDF
-// translation, ImageMagick to convert the PDF to a PNG.
-type XelatexImagemagickRenderer struct {
-	error error
+// The path of the image the scroll with the given ID is rendered to, unless it
+// spans several pages
+func (r *TexRenderer) imagePath(id common.ID) string {
+	return r.library.CacheFile(id, r.converter.extension)
 }
 
-func (x *XelatexImagemagickRenderer) scrollToLatex(id common.ID) {
-	var e errTemplateReader
+// The path of the image of the only or the first page of the scroll
+func (r *TexRenderer) firstImage(id common.ID) string {
+	if _, err := os.Stat(r.imagePath(id)); err != nil {
+		return r.library.PageFile(id, 0, r.converter.extension)
+	}
+	return r.imagePath(id)
+}
+
+// Identify the LaTeX file together with all the settings affecting the
+// resulting image, i.e. the command lines of TeX and of the converter.
+func (r *TexRenderer) cacheKey(doc latexDocument) string {
+	parts := append(r.engine.command("scroll", ""), r.converter.command("scroll.pdf", 0, "scroll"+r.converter.extension)...)
+	return common.CacheKey(append(parts, doc.String())...)
+}
 
-	scrollText, err := common.ReadScroll(id)
+// Run a command in the temp directory, killing it when the context expires.
+func (r *TexRenderer) run(ctx context.Context, command []string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Dir = r.tempDirectory
+	cmd.Env = append(os.Environ(), restrictedTexEnvironment...)
+	return cmd.CombinedOutput()
+}
+
+// Run TeX on the LaTeX file with the given name using the given format.  If
+// TeX rejects the format, e.g. because TeX has been updated since the format
+// was built, the format is deleted and the file compiled without it.
+func (r *TexRenderer) compile(ctx context.Context, name, format string) ([]byte, error) {
+	msg, err := r.run(ctx, r.engine.command(name, format))
+	if err != nil && format != "" && strings.Contains(string(msg), "format file") {
+		common.TryLogError(os.Remove(r.tempDirectory + format + ".fmt"))
+		common.TryLogError(os.Remove(r.formatDirectory + format + ".fmt"))
+		return r.run(ctx, r.engine.command(name, ""))
+	}
+	return msg, err
+}
+
+// Keep TeX from running other programs, and from reading or writing files
+// outside of the temp directory, e.g. ~/.ssh/id_rsa, no matter what the scroll
+// tries to \input or \openout.
+var restrictedTexEnvironment = []string{"openin_any=p", "openout_any=p", "shell_escape=f"}
+
+// Compile the LaTeX file for the scroll with the given ID to produce a PDF
+// file, returning the number of pages, or 0 if it is not known.  Both input
+// and output files are in the temp directory.  If possible, a precompiled
+// format containing the preamble is used.  Errors reported by TeX are mapped
+// back to the line of the scroll causing them.
+func (r *TexRenderer) latexToPdf(ctx context.Context, id common.ID, doc latexDocument) (int, error) {
+	var format string
+	if preamble, _, ok := splitDocument(doc); ok {
+		format = r.format(ctx, preamble)
+	}
+	// The paths are relative to the temp directory, as absolute ones are
+	// rejected by TeX given restrictedTexEnvironment.
+	msg, err := r.compile(ctx, string(id), format)
+	if err == nil {
+		return numPages(string(msg)), nil
+	}
+	if err := r.contextError(ctx, id, common.StageLatex); err != nil {
+		return 0, err
+	}
+
+	message, line := parseLatexError(string(msg))
+	return 0, &common.RenderError{
+		ID:      id,
+		Stage:   common.StageLatex,
+		Line:    scrollLine(doc, line),
+		Message: message,
+		Err:     errors.Wrapf(err, "TeX build: %v", string(msg)),
+	}
+}
+
+// Convert a page of the PDF file with the given name to an image for the
+// scroll with the given ID.  Page 0 stands for the only page of a PDF
+// containing a single scroll.  From the cache directory, the image can be
+// served by the web server or displayed to the user via some other user
+// interface.
+func (r *TexRenderer) pdfToImage(ctx context.Context, id common.ID, name string, page int, image string) error {
+	command := r.converter.command(name+".pdf", page, image)
+	msg, err := r.run(ctx, command)
+	if err == nil {
+		return nil
+	}
+	if err := r.contextError(ctx, id, common.StageConvert); err != nil {
+		return err
+	}
+	return &common.RenderError{ID: id, Stage: common.StageConvert,
+		Err: errors.Wrapf(err, "%v: %v", command[0], string(msg))}
+}
+
+// Delete the intermediate files for the LaTeX file with the given name.
+func (r *TexRenderer) deleteTemporaryFiles(name string) {
+	files, err := filepath.Glob(r.tempDirectory + name + ".*")
 	if err != nil {
-		if os.IsNotExist(err) {
-			err = common.RemoveFromIndex(id)
-			if err != nil {
-				common.LogError(err)
-			}
-			x.error = errNoSuchScroll
-			return
+		common.LogError(err)
+		return
+	}
+	for _, file := range files {
+		common.TryLogError(os.Remove(file))
+	}
+}
+
+// Describe the failure of a command that was killed because the context
+// expired, either because rendering took too long or because it is no longer
+// needed.  Returns nil if the context has not expired.
+func (r *TexRenderer) contextError(ctx context.Context, id common.ID, stage common.RenderStage) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return &common.RenderError{
+			ID:      id,
+			Stage:   stage,
+			Message: "timed out after " + r.library.Config().RenderTimeout.String(),
+			Err:     errors.Wrapf(common.ErrRenderTimeout, "rendering %v", id),
 		}
-		x.error = err
+	default:
+		return &common.RenderError{ID: id, Stage: stage, Err: ctx.Err()}
+	}
+}
+
+type errTemplateReader struct {
+	library *common.Library
+	scroll  common.Scroll
+	doc     string
+	err     error
+}
+
+// Load a template file from disk, execute it for the scroll and propagate
+// errors
+func (e *errTemplateReader) readTemplate(name string) {
+	if e.err != nil {
 		return
 	}
-	scroll := parse(string(id), scrollText)
+
+	tmp, err := readAndExecuteTemplate(e.library, name, e.scroll)
+	e.err = errors.Wrapf(err, "read template %v", name)
+	e.doc += tmp
+}
+
+// latexDocument is the LaTeX file generated for a scroll.
+type latexDocument struct {
+	// The header template
+	header string
+	// The content of the scroll wrapped in the templates for its type
+	body string
+	// The footer template
+	footer string
+	// The number of lines preceding the content of the scroll
+	contentOffset int
+	// The lines of the scroll the lines of its content come from, see
+	// Scroll.ContentLines
+	contentLines []int
+}
+
+func (d latexDocument) String() string {
+	return d.header + d.body + d.footer
+}
+
+// Create a LaTeX file from the content of the given scroll together with all
+// the appropriate templates.  If the fallback templates had to be used, a
+// warning is returned as well.
+func scrollToLatex(l *common.Library, knownTypes map[string]bool, scroll common.Scroll) (doc latexDocument, warning, err error) {
+	e := errTemplateReader{library: l, scroll: scroll}
+	scrollType, warning := templateType(knownTypes, scroll.ID, scroll.Type)
 
 	e.readTemplate("header")
-	e.readTemplate(scroll.Type + "_header")
+	doc.header = e.doc
+	e.readTemplate(scrollType + "_header")
+	doc.contentOffset = strings.Count(e.doc, "\n")
+	doc.contentLines = scroll.ContentLines
 	e.doc += scroll.Content
-	e.readTemplate(scroll.Type + "_footer")
+	e.readTemplate(scrollType + "_footer")
+	doc.body = e.doc[len(doc.header):]
 	e.readTemplate("footer")
+	doc.footer = e.doc[len(doc.header)+len(doc.body):]
 
 	if e.err != nil {
-		x.error = errors.Wrapf(e.err, "producing latex file for scroll %v", id)
-		return
+		return doc, nil, errors.Wrapf(e.err, "producing latex file for scroll %v", scroll.ID)
 	}
-	err = common.WriteTemp(id, e.doc)
-	x.error = errors.Wrapf(err, "writing latex file %v.tex to temporary directory", id)
+	return doc, warning, nil
 }
 
-func (x *XelatexImagemagickRenderer) latexToPdf(id common.ID) {
-	if x.error != nil {
-		return
+// Extract the error message, i.e. the first line starting with "!", and the
+// number of the line the error occurred in from the output of a TeX run.  If
+// the line number cannot be determined, 0 is returned.
+func parseLatexError(output string) (string, int) {
+	var message string
+	for _, line := range strings.Split(output, "\n") {
+		if message == "" {
+			if strings.HasPrefix(line, "! ") {
+				message = strings.TrimSpace(strings.TrimPrefix(line, "! "))
+			} else if groups := tectonicErrorPattern.FindStringSubmatch(line); groups != nil {
+				// Tectonic reports both on a single line.
+				lineNumber, _ := strconv.Atoi(groups[1])
+				return strings.TrimSpace(groups[2]), lineNumber
+			}
+			continue
+		}
+		groups := texLineNumberPattern.FindStringSubmatch(line)
+		if groups != nil {
+			lineNumber, _ := strconv.Atoi(groups[1])
+			return message, lineNumber
+		}
 	}
-
-	msg, err := exec.Command("xelatex",
-		"-halt-on-error", "-output-directory", common.Config.TempDirectory,
-		common.Config.TempDirectory+string(id)).CombinedOutput()
-	x.error = errors.Wrapf(err, "XeLaTeX build: %v", string(msg))
+	return message, 0
 }
 
-func (x *XelatexImagemagickRenderer) pdfToPng(i common.ID) {
-	if x.error != nil {
-		return
+// Determine the number of pages of the PDF file from the output of a TeX
+// run, or return 0 if TeX does not say.
+func numPages(output string) int {
+	groups := texOutputPattern.FindStringSubmatch(output)
+	if groups == nil {
+		return 0
 	}
+	n, _ := strconv.Atoi(groups[1])
+	return n
+}
 
-	id := string(i)
-	x.error = exec.Command("convert", "-trim",
-		"-quality", strconv.Itoa(common.Config.Quality),
-		"-density", strconv.Itoa(common.Config.Dpi),
-		common.Config.TempDirectory+id+".pdf", common.Config.CacheDirectory+id+".png").Run()
+var (
+	texOutputPattern     = regexp.MustCompile(`Output written on .*\((\d+) pages?`)
+	texLineNumberPattern = regexp.MustCompile(`^l\.(\d+)`)
+	tectonicErrorPattern = regexp.MustCompile(`^error: [^:]*\.tex:(\d+): (.*)`)
+)
 
+// Map a line of the generated LaTeX file to the corresponding line of the
+// scroll.  If the line is part of a template rather than of the scroll, 0 is
+// returned.
+func scrollLine(doc latexDocument, docLine int) int {
+	i := docLine - doc.contentOffset - 1
+	if i < 0 || i >= len(doc.contentLines) {
+		return 0
+	}
+	return doc.contentLines[i]
 }
 
-func (x *XelatexImagemagickRenderer) deleteTemporaryFiles(id common.ID) {
-	if x.error != nil {
-		return
-	}
+// The template used for scrolls without a type or with an unknown one
+const fallbackType = "fallback"
 
-	files, err := filepath.Glob(common.Config.TempDirectory + string(id) + ".*")
-	if err != nil {
-		common.LogError(err)
-		return
+// Determine which templates to use for a scroll of the given type.  If it is
+// not one of the known types, the fallback templates are used, and a warning
+// is returned.
+func templateType(knownTypes map[string]bool, id common.ID, scrollType string) (string, error) {
+	if scrollType == "" {
+		return fallbackType, &common.RenderWarning{ID: id,
+			Message: "no @type given, using the fallback template"}
 	}
-	for _, file := range files {
-		common.TryLogError(os.Remove(file))
+	if !knownTypes[scrollType] {
+		return fallbackType, &common.RenderWarning{ID: id,
+			Message: "unknown @type '" + scrollType + "', using the fallback template"}
 	}
+	return scrollType, nil
 }
 
-func (x *XelatexImagemagickRenderer) err() error {
-	return x.error
+// renderScroll loads the scroll with the given ID and renders it using the
+// given renderer.  If the scroll was rendered despite some problem, a
+// RenderWarning is returned.  If rendering takes longer than
+// Config.RenderTimeout, it is aborted and an error caused by
+// common.ErrRenderTimeout is returned.
+func (b LatexToPngBackend) renderScroll(ctx context.Context, id common.ID, renderer Renderer) error {
+	scroll, err := loadScroll(b.Library, id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withRenderTimeout(ctx, b.Library.Config().RenderTimeout, 1)
+	defer cancel()
+	_, err = renderer.Render(ctx, scroll)
+	logRenderError(err)
+	return err
 }
 
-// renderScroll takes a scroll ID and a renderer to create a PNG image from
-// that scroll.
-func renderScroll(id common.ID, renderer latexToPngRenderer) error {
-	if common.IsUpToDate(id) {
-		return nil
+// Load and parse the scroll with the given ID.  If it no longer exists, it is
+// removed from the index.
+func loadScroll(l *common.Library, id common.ID) (common.Scroll, error) {
+	doc, err := l.ReadScrollToRender(id)
+	if err != nil {
+		return common.Scroll{}, err
 	}
+	return parse(l, string(id), doc), nil
+}
 
-	renderer.scrollToLatex(id)
-	renderer.latexToPdf(id)
-	renderer.pdfToPng(id)
-	common.TryLogError(renderer.err())
-	renderer.deleteTemporaryFiles(id)
+// Limit the time rendering the given number of scrolls may take, given the
+// time allowed per scroll, usually Config.RenderTimeout.
+func withRenderTimeout(ctx context.Context, timeout time.Duration, numScrolls int) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout*time.Duration(numScrolls))
+}
 
-	return errors.Wrap(renderer.err(), "rendering")
+// Log errors, including the full TeX output, but not mere warnings.
+func logRenderError(err error) {
+	if !common.IsRenderWarning(err) {
+		common.TryLogError(err)
+	}
 }
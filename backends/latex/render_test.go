@@ -0,0 +1,110 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package latex
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLatexError(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		message string
+		line    int
+	}{
+		{
+			name:    "xelatex",
+			output:  "This is XeTeX, Version 3.14159265\n(./s1.tex\n! Undefined control sequence.\nl.12 \\foo\n          \n",
+			message: "Undefined control sequence.",
+			line:    12,
+		},
+		{
+			name: "context lines before the line number",
+			output: "! Missing $ inserted.\n<inserted text> \n                $\n" +
+				"<to be read again> \n                   ^\nl.7 a^\n        b\n",
+			message: "Missing $ inserted.",
+			line:    7,
+		},
+		{
+			name:    "first error only",
+			output:  "! Undefined control sequence.\nl.3 \\foo\n! Missing } inserted.\nl.9 }\n",
+			message: "Undefined control sequence.",
+			line:    3,
+		},
+		{
+			name:    "line number before the error",
+			output:  "l.2 something\n! Emergency stop.\n",
+			message: "Emergency stop.",
+			line:    0,
+		},
+		{
+			name:    "tectonic",
+			output:  "note: Running TeX ...\nerror: s1.tex:5: Undefined control sequence\nerror: halted on potentially-recoverable error as specified\n",
+			message: "Undefined control sequence",
+			line:    5,
+		},
+		{
+			name:    "no error",
+			output:  "Output written on s1.pdf (1 page, 1234 bytes).\n",
+			message: "",
+			line:    0,
+		},
+		{
+			name:    "empty",
+			output:  "",
+			message: "",
+			line:    0,
+		},
+	}
+	for _, test := range tests {
+		message, line := parseLatexError(test.output)
+		if message != test.message || line != test.line {
+			t.Errorf("%v: got %q, %d, expected %q, %d", test.name, message, line, test.message, test.line)
+		}
+	}
+}
+
+func TestStripComments(t *testing.T) {
+	tests := []struct {
+		doc     string
+		content string
+		lines   []int
+	}{
+		{"a\nb\n\nc\n\n% @type lemma\n% foo\n", "a\nb\n\nc", []int{1, 2, 3, 4}},
+		{"% @source Author\n\nfirst\n\n% comment\n\nlast\n\n\n", "first\n\nlast", []int{3, 4, 7}},
+		{"\n\n\na\n\n\n\n  b\n  c  \n\nd", "a\n\n\n\nb\n  c\n\nd", []int{4, 5, 6, 7, 8, 9, 10, 11}},
+		{"% @type lemma\n", "", nil},
+		{"", "", nil},
+	}
+	for _, test := range tests {
+		content, lines := stripComments(test.doc)
+		if content != test.content || !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("stripComments(%q) = %q, %v, expected %q, %v",
+				test.doc, content, lines, test.content, test.lines)
+		}
+	}
+}
+
+func TestScrollLine(t *testing.T) {
+	doc := latexDocument{contentOffset: 10, contentLines: []int{3, 4, 7}}
+	tests := []struct {
+		docLine, want int
+	}{
+		{0, 0},
+		{10, 0},
+		{11, 3},
+		{12, 4},
+		{13, 7},
+		{14, 0},
+	}
+	for _, test := range tests {
+		if got := scrollLine(doc, test.docLine); got != test.want {
+			t.Errorf("scrollLine(%d) = %d, expected %d", test.docLine, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package latex
+
+import (
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+
+	"github.com/yzhs/alexandria/common"
+)
+
+// The delimiters of actions in TeX templates.  Unlike the default {{ and }},
+// they do not clash with LaTeX's braces.
+const (
+	templateLeftDelim  = "<<"
+	templateRightDelim = ">>"
+)
+
+var latexEscaper = strings.NewReplacer(
+	`\`, `\textbackslash{}`,
+	`{`, `\{`,
+	`}`, `\}`,
+	`&`, `\&`,
+	`%`, `\%`,
+	`$`, `\$`,
+	`#`, `\#`,
+	`_`, `\_`,
+	`~`, `\textasciitilde{}`,
+	`^`, `\textasciicircum{}`,
+)
+
+// Undo latexEscaper, e.g. for showing an escaped string in HTML
+var latexUnescaper = strings.NewReplacer(
+	`\textbackslash{}`, `\`,
+	`\{`, `{`,
+	`\}`, `}`,
+	`\&`, `&`,
+	`\%`, `%`,
+	`\$`, `$`,
+	`\#`, `#`,
+	`\_`, `_`,
+	`\textasciitilde{}`, `~`,
+	`\textasciicircum{}`, `^`,
+)
+
+// Functions available in TeX templates in addition to the builtin ones
+var templateFuncs = template.FuncMap{
+	// Escape all characters with a special meaning in LaTeX
+	"escape": latexEscaper.Replace,
+	"join":   strings.Join,
+}
+
+// executeTemplate treats the content of a TeX template as a Go text/template
+// and executes it with the given scroll as its data.  The template can thus
+// refer to the scroll's metadata, e.g.
+//
+//	\begin{theorem*}<<with .SourceLines>>[{<<escape (join . "; ")>>}]<<end>>
+func executeTemplate(name, text string, scroll common.Scroll) (string, error) {
+	tmpl, err := template.New(name).Delims(templateLeftDelim, templateRightDelim).
+		Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse template %v", name)
+	}
+
+	var result strings.Builder
+	err = tmpl.Execute(&result, scroll)
+	return result.String(), errors.Wrapf(err, "execute template %v", name)
+}
+
+// Load a template and execute it for the given scroll.
+func readAndExecuteTemplate(l *common.Library, name string, scroll common.Scroll) (string, error) {
+	text, err := l.ReadTemplate(name)
+	if err != nil {
+		return "", err
+	}
+	return executeTemplate(name, text, scroll)
+}
@@ -0,0 +1,34 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package markdown
+
+import (
+	"context"
+
+	"github.com/yzhs/alexandria/common"
+)
+
+type ID = common.ID
+
+// MarkdownToHTMLBackend handles scrolls written in Markdown.  They are
+// rendered to HTML fragments, leaving any mathematics to be typeset by the
+// browser.
+type MarkdownToHTMLBackend struct {
+	Library *common.Library
+}
+
+func (b MarkdownToHTMLBackend) RenderAllScrolls(ctx context.Context) (numScrolls int, errors []error) {
+	ids, err := b.Library.ScrollIDs(".md")
+	if err != nil {
+		return 0, []error{err}
+	}
+	renderedIDs, errors := b.RenderScrollsByID(ctx, ids)
+	return len(renderedIDs), errors
+}
+
+func (b MarkdownToHTMLBackend) RenderScrollsByID(ctx context.Context, ids []common.ID) (renderedScrollIDs []common.ID, errors []error) {
+	return common.RenderOneByOne(ctx, ids, b.renderScroll)
+}
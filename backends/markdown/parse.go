@@ -0,0 +1,160 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package markdown
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/yzhs/alexandria/common"
+)
+
+// Split a document into its YAML front matter, i.e. the lines between an
+// initial line containing only `---` and the next line containing only `---`
+// or `...`, and the rest of the document.  If there is no front matter, the
+// first return value is empty.
+func splitFrontMatter(doc string) (string, string) {
+	lines := strings.Split(doc, "\n")
+	if strings.TrimSpace(lines[0]) != "---" {
+		return "", doc
+	}
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "---" || line == "..." {
+			frontMatter := strings.Join(lines[1:i], "\n")
+			rest := strings.Join(lines[i+1:], "\n")
+			return frontMatter, rest
+		}
+	}
+	return "", doc
+}
+
+// Convert a YAML value, which should be a string or a list of strings, into a
+// slice of strings.
+func yamlValues(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		var result []string
+		for _, item := range v {
+			result = append(result, yamlValues(item)...)
+		}
+		return result
+	default:
+		return []string{strings.TrimSpace(fmt.Sprint(v))}
+	}
+}
+
+// Translate the YAML front matter into the same metadata lines used in the
+// final comment block of LaTeX scrolls.
+func frontMatterToMetadataLines(frontMatter string) ([]string, error) {
+	var fields yaml.MapSlice
+	err := yaml.Unmarshal([]byte(frontMatter), &fields)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse YAML front matter")
+	}
+
+	var metadata []string
+	for _, field := range fields {
+		key := strings.ToLower(fmt.Sprint(field.Key))
+		values := yamlValues(field.Value)
+		if len(values) == 0 {
+			continue
+		}
+		switch key {
+		case "source":
+			for _, source := range values {
+				metadata = append(metadata, "@source "+source)
+			}
+		case "tag", "tags":
+			metadata = append(metadata, strings.Join(values, ", "))
+		default:
+			metadata = append(metadata, "@"+key+" "+strings.Join(values, ", "))
+		}
+	}
+	return metadata, nil
+}
+
+// Split a document into its content and the lines of the final HTML comment,
+// if the document ends in one.  Leading and trailing whitespace is removed
+// from each line, and empty lines are dropped.
+func splitMetadataComment(doc string) (string, []string) {
+	trimmedDoc := strings.TrimSpace(doc)
+	if !strings.HasSuffix(trimmedDoc, "-->") {
+		return doc, nil
+	}
+	start := strings.LastIndex(trimmedDoc, "<!--")
+	if start == -1 {
+		return doc, nil
+	}
+
+	comment := strings.TrimSuffix(trimmedDoc[start+len("<!--"):], "-->")
+	var metadata []string
+	for _, line := range strings.Split(comment, "\n") {
+		trimmedLine := strings.TrimSpace(line)
+		if trimmedLine != "" {
+			metadata = append(metadata, trimmedLine)
+		}
+	}
+	return trimmedDoc[:start], metadata
+}
+
+// Parse a Markdown scroll.  The metadata can be given either as YAML front
+// matter,
+//
+//	---
+//	type: proposition
+//	source: ["Author: Title", "Lemma 3.2, p. 41"]
+//	tags: [counter-example, analysis]
+//	---
+//	Markdown text with $\LaTeX$ maths ...
+//
+// or, just like in LaTeX scrolls, in a final block of comments:
+//
+//	Markdown text with $\LaTeX$ maths ...
+//
+//	<!--
+//	@source Author: Title
+//	@source Lemma 3.2, p. 41
+//	@type proposition
+//	counter-example, analysis
+//	-->
+//
+// Both forms may be combined, in which case the metadata is merged.
+//
+// If the front matter cannot be parsed, it is ignored and the error returned
+// together with the scroll.
+func parse(l *common.Library, id, doc string) (common.Scroll, error) {
+	frontMatter, rest := splitFrontMatter(doc)
+	metadata, err := frontMatterToMetadataLines(frontMatter)
+
+	content, commentLines := splitMetadataComment(rest)
+	metadata = append(metadata, commentLines...)
+
+	return l.ParseMetadata(common.ID(id), strings.TrimSpace(content), metadata), err
+}
+
+func (b MarkdownToHTMLBackend) Parse(id, doc string) common.Scroll {
+	scroll, err := parse(b.Library, id, doc)
+	if err != nil {
+		common.LogError(errors.Wrapf(err, "scroll %v", id))
+	}
+	return scroll
+}
+
+// ParseAndCheck parses a scroll, returning front matter that is not valid YAML
+// as an error.
+func (b MarkdownToHTMLBackend) ParseAndCheck(id, doc string) (common.Scroll, []error) {
+	scroll, err := parse(b.Library, id, doc)
+	if err != nil {
+		return scroll, []error{err}
+	}
+	return scroll, nil
+}
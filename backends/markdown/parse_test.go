@@ -0,0 +1,59 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package markdown
+
+import "testing"
+
+func TestSplitFrontMatter(t *testing.T) {
+	tests := []struct {
+		name, doc, frontMatter, rest string
+	}{
+		{
+			name:        "front matter",
+			doc:         "---\ntype: definition\ntags: [topology]\n---\nA *space*.\n",
+			frontMatter: "type: definition\ntags: [topology]",
+			rest:        "A *space*.\n",
+		},
+		{
+			name:        "terminated by dots",
+			doc:         "---\ntype: lemma\n...\nBody",
+			frontMatter: "type: lemma",
+			rest:        "Body",
+		},
+		{
+			name:        "whitespace around the delimiters",
+			doc:         "--- \ntype: lemma\n  ---\t\nBody",
+			frontMatter: "type: lemma",
+			rest:        "Body",
+		},
+		{
+			name:        "empty front matter",
+			doc:         "---\n---\nBody",
+			frontMatter: "",
+			rest:        "Body",
+		},
+		{
+			name: "no front matter",
+			doc:  "Body\n---\nMore",
+			rest: "Body\n---\nMore",
+		},
+		{
+			name: "unterminated",
+			doc:  "---\ntype: lemma\nBody",
+			rest: "---\ntype: lemma\nBody",
+		},
+		{
+			name: "empty document",
+		},
+	}
+	for _, test := range tests {
+		frontMatter, rest := splitFrontMatter(test.doc)
+		if frontMatter != test.frontMatter || rest != test.rest {
+			t.Errorf("%v: got %q, %q, expected %q, %q",
+				test.name, frontMatter, rest, test.frontMatter, test.rest)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package markdown
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+
+	"github.com/yzhs/alexandria/common"
+)
+
+// converterVersion has to be incremented whenever the way Markdown is
+// converted to HTML changes, so that scrolls rendered before are not reused.
+const converterVersion = 1
+
+var converter = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// markdownToHTML converts the content of a scroll to an HTML fragment.
+func markdownToHTML(content string) (string, error) {
+	protected, formulae := common.ProtectMath(content)
+	var buf bytes.Buffer
+	err := converter.Convert([]byte(protected), &buf)
+	if err != nil {
+		return "", errors.Wrap(err, "convert Markdown to HTML")
+	}
+	return common.RestoreMath(buf.String(), formulae), nil
+}
+
+// renderScroll converts the Markdown scroll with the given ID to HTML and
+// stores the result in the cache directory.  Any problem is reported as a
+// RenderError.
+func (b MarkdownToHTMLBackend) renderScroll(id common.ID) error {
+	l := b.Library
+	doc, err := l.ReadScrollToRender(id)
+	if err != nil {
+		return err
+	}
+	key := common.CacheKey("markdown", strconv.Itoa(converterVersion), doc)
+	if l.IsCached(id, ".html", key) {
+		return nil
+	}
+	scroll := b.Parse(string(id), doc)
+
+	result, err := markdownToHTML(scroll.Content)
+	if err != nil {
+		return &common.RenderError{ID: id, Stage: common.StageConvert, Err: err}
+	}
+	err = ioutil.WriteFile(l.CacheFile(id, ".html"), []byte(result), 0644)
+	if err != nil {
+		err = errors.Wrapf(err, "write %v.html to cache directory", id)
+		return &common.RenderError{ID: id, Stage: common.StageConvert, Err: err}
+	}
+	common.TryLogError(l.RecordCacheKey(id, key))
+	return nil
+}
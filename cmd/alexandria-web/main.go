@@ -6,11 +6,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
 	"strings"
 
@@ -19,21 +22,22 @@ import (
 	"github.com/yzhs/alexandria"
 )
 
-const (
-	LISTEN_ON   = "127.0.0.1:41665"
-	MAX_RESULTS = 100
-)
+const MAX_RESULTS = 100
 
 // Send the statistics page to the client.
-func statsHandler(w http.ResponseWriter, r *http.Request) {
-	stats, err := alexandria.ComputeStatistics()
-	if err != nil {
-		fmt.Fprint(w, err)
-		return
+func statsHandler(library *alexandria.Library) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := library.ComputeStatistics()
+		if err != nil {
+			fmt.Fprint(w, err)
+			return
+		}
+		n := stats.NumberOfScrolls()
+		size := float32(stats.TotalSize()) / 1024.0
+		fmt.Fprintf(w, "The library contains %v scrolls with a total size of %.1f kiB.\n", n, size)
+		reclaimable := float32(stats.ReclaimableSize()) / 1024.0
+		fmt.Fprintf(w, "Unused files in the cache take up %.1f kiB.\n", reclaimable)
 	}
-	n := stats.NumberOfScrolls()
-	size := float32(stats.TotalSize()) / 1024.0
-	fmt.Fprintf(w, "The library contains %v scrolls with a total size of %.1f kiB.\n", n, size)
 }
 
 // Handle the edit-link, causing the browser to open that scroll in an editor.
@@ -48,11 +52,94 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, alexandria.Config.TemplateDirectory+"html/main.html")
 }
 
+type match struct {
+	alexandria.Scroll
+	// Images are the names of the images the scroll was rendered to, one
+	// per page, if any.
+	Images []string
+	// HTML contains the rendered scroll if it was rendered to HTML
+	// rather than to an image.
+	HTML template.HTML
+	// Failure describes why the scroll could not be rendered, or the
+	// warning produced while rendering it, if any.
+	Failure *failure
+}
+
+// failure describes a scroll that could not be rendered, or one that was
+// rendered despite some problem, in which case Warning is true.
+type failure struct {
+	ID      alexandria.ID
+	Warning bool
+	Stage   string
+	Line    int
+	Message string
+}
+
 type result struct {
 	Query        string
-	Matches      []alexandria.Scroll
+	Matches      []match
 	NumMatches   int
 	TotalMatches int
+	PageSize     int
+	Failures     []failure
+	// Whether the results may come from several libraries
+	Federated bool
+}
+
+// Extract the details of the errors that occurred while rendering.
+func newFailures(errs []error) []failure {
+	failures := make([]failure, len(errs))
+	for i, err := range errs {
+		var warning *alexandria.RenderWarning
+		var renderError *alexandria.RenderError
+		if errors.As(err, &warning) {
+			failures[i] = failure{ID: warning.ID, Warning: true, Message: warning.Message}
+		} else if errors.As(err, &renderError) {
+			failures[i] = failure{ID: renderError.ID, Stage: string(renderError.Stage),
+				Line: renderError.Line, Message: renderError.Message}
+			if failures[i].Message == "" && renderError.Err != nil {
+				failures[i].Message = renderError.Err.Error()
+			}
+		} else {
+			failures[i].Message = err.Error()
+		}
+	}
+	return failures
+}
+
+// Combine the scrolls with the images or HTML they were rendered to, or with
+// the reason they could not be rendered.
+func newMatches(scrolls []alexandria.Scroll, failures map[alexandria.ID]*failure) []match {
+	matches := make([]match, len(scrolls))
+	for i, scroll := range scrolls {
+		matches[i].Scroll = scroll
+		matches[i].Failure = failures[scroll.ID]
+		if matches[i].Failure != nil && !matches[i].Failure.Warning {
+			// Do not show images left over from an older version.
+			continue
+		}
+		paths := alexandria.RenderedFiles(scroll.ID)
+		if len(paths) == 0 {
+			continue
+		}
+		path := paths[0]
+		if !strings.HasSuffix(path, ".html") {
+			// The images of scrolls from other libraries are served
+			// from /images/<library>/, see serveImages.
+			prefix, _ := filepath.Split(string(scroll.ID))
+			for _, path := range paths {
+				matches[i].Images = append(matches[i].Images, prefix+filepath.Base(path))
+			}
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		matches[i].HTML = template.HTML(content)
+	}
+	return matches
 }
 
 func renderTemplate(w http.ResponseWriter, templateFile string, resultData result) {
@@ -70,32 +157,66 @@ func min(a, b int) int {
 }
 
 // Handle a query and serve the results.
-func queryHandler(b alexandria.Backend) func(http.ResponseWriter, *http.Request) {
+func queryHandler(b alexandria.Backend, library *alexandria.Library) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		query := r.FormValue("q")
 		if query == "" {
 			mainHandler(w, r)
 			return
 		}
-		ids, totalMatches, err := alexandria.FindMatchingScrolls(query)
+		ids, totalMatches, err := library.FindMatchingScrolls(query)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		ids, errors := b.RenderScrollsByID(ids)
-		if len(errors) != 0 {
-			errorStrings := make([]string, len(errors))
-			for i, err := range errors {
-				errorStrings[i] = err.Error()
-				fmt.Fprintf(os.Stderr, "%v;\n", errorStrings[i])
+		renderedIDs, errors := b.RenderScrollsByID(r.Context(), ids)
+		for _, err := range errors {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+
+		// Show the scrolls that could not be rendered among the others,
+		// with the reason in place of the image.
+		failures := newFailures(errors)
+		failuresByID := make(map[alexandria.ID]*failure)
+		for i := range failures {
+			if failures[i].ID != "" {
+				failuresByID[failures[i].ID] = &failures[i]
+			}
+		}
+		rendered := make(map[alexandria.ID]bool)
+		for _, id := range renderedIDs {
+			rendered[id] = true
+		}
+		var shownIDs []alexandria.ID
+		for _, id := range ids {
+			if rendered[id] || failuresByID[id] != nil {
+				shownIDs = append(shownIDs, id)
+			}
+		}
+		numMatches := len(shownIDs)
+		shownIDs = shownIDs[:min(alexandria.Config.PageSize, numMatches)]
+		results, err := alexandria.LoadScrolls(shownIDs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		matches := newMatches(results, failuresByID)
+
+		// Failures of scrolls not shown are listed at the top.
+		shown := make(map[alexandria.ID]bool)
+		for _, id := range shownIDs {
+			shown[id] = true
+		}
+		var otherFailures []failure
+		for _, f := range failures {
+			if !shown[f.ID] {
+				otherFailures = append(otherFailures, f)
 			}
-			http.Error(w, strings.Join(errorStrings, ";\n"), http.StatusInternalServerError)
-			return
 		}
-		numMatches := len(ids)
-		results, err := alexandria.LoadScrolls(ids)
-		data := result{Query: query, NumMatches: numMatches, Matches: results[:min(20, numMatches)], TotalMatches: totalMatches}
+
+		data := result{Query: query, NumMatches: numMatches, Matches: matches,
+			TotalMatches: totalMatches, PageSize: alexandria.Config.PageSize,
+			Federated: len(library.Members()) > 0, Failures: otherFailures}
 		renderTemplate(w, "search", data)
 	}
 }
@@ -104,6 +225,15 @@ func serveDirectory(prefix string, directory string) {
 	http.Handle(prefix, http.StripPrefix(prefix, http.FileServer(http.Dir(directory))))
 }
 
+// Serve the images the scrolls of the library have been rendered to, as well
+// as those of the other libraries searched together with it.
+func serveImages(library *alexandria.Library) {
+	serveDirectory("/images/", library.Config().CacheDirectory)
+	for name, member := range library.Members() {
+		serveDirectory("/images/"+name+"/", member.Config().CacheDirectory)
+	}
+}
+
 // Load gets a parsed template.Template, whether from cache or from disk.
 func loadTemplate(name string) *template.Template {
 	relPath := "html/" + name + ".html"
@@ -130,13 +260,46 @@ func loadTemplateFromAssets(relPath string) (*template.Template, error) {
 	return template.New(relPath).Parse(string(content))
 }
 
+// Keep the index up to date with the library while the server is running, so
+// new scrolls can be found without restarting it.  If prerender is set, the
+// scrolls that were added or modified are rendered in the background, so
+// they are ready by the time they are searched for.
+func watchLibrary(b alexandria.Backend, prerender bool) {
+	ctx := context.Background()
+	err := alexandria.WatchLibrary(ctx, func(update alexandria.IndexUpdate, err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		if prerender && len(update.Changed) > 0 {
+			_, errors := b.RenderScrollsByID(ctx, update.Changed)
+			for _, err := range errors {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+		}
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+}
+
 func main() {
-	var profile, version bool
+	var prerender, profile, version bool
+	var configFile, libraryDirectory string
+	flag.StringVar(&configFile, "config", "", "\tRead the configuration from this file")
+	flag.StringVar(&libraryDirectory, "library", alexandria.DefaultDirectory(), "\tUse the library in this directory")
+	flag.BoolVar(&prerender, "prerender", false, "\tRender scrolls as soon as they are added or modified")
 	flag.BoolVarP(&version, "version", "v", false, "\tShow version")
 	flag.BoolVar(&profile, "profile", false, "\tEnable profiler")
 	flag.Parse()
 
-	alexandria.Config.MaxResults = MAX_RESULTS
+	config := alexandria.NewConfiguration(libraryDirectory)
+	config.MaxResults = MAX_RESULTS
+	config, err := alexandria.LoadConfiguration(config, configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	*alexandria.Config = config
 
 	if profile {
 		f, err := os.Create("alexandria.prof")
@@ -152,16 +315,42 @@ func main() {
 		return
 	}
 
+	// Keep the index open while the server is running, and let the
+	// command line interface use it, too.
+	library, err := alexandria.OpenLibrary()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer library.Close()
+	go func() {
+		err := library.Serve()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+	}()
+
 	b := alexandria.NewBackend()
-	alexandria.UpdateIndex()
+	update, err := library.UpdateIndex()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	} else {
+		fmt.Printf("Added %d, updated %d and removed %d scrolls.\n",
+			update.Added, update.Updated, update.Removed)
+		if update.Garbage.NumFiles > 0 {
+			fmt.Printf("Deleted %d unused files.\n", update.Garbage.NumFiles)
+		}
+	}
+
+	go watchLibrary(b, prerender)
 
 	http.HandleFunc("/", mainHandler)
-	http.HandleFunc("/stats", statsHandler)
-	http.HandleFunc("/search", queryHandler(b))
+	http.HandleFunc("/stats", statsHandler(library))
+	http.HandleFunc("/search", queryHandler(b, library))
 	http.HandleFunc("/alexandria.edit", editHandler)
-	serveDirectory("/images/", alexandria.Config.CacheDirectory)
+	serveImages(library)
 	http.Handle("/static/", http.FileServer(alexandria.Assets))
-	err := http.ListenAndServe(LISTEN_ON, nil)
+	err = http.ListenAndServe(alexandria.Config.ListenAddress, nil)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v", err)
 	}
@@ -6,9 +6,12 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 
 	flag "github.com/ogier/pflag"
@@ -17,14 +20,27 @@ import (
 )
 
 func main() {
-	var index, profile, stats, version bool
+	var index, jsonOutput, prerender, profile, stats, version bool
+	var configFile, libraryDirectory string
+	flag.StringVar(&configFile, "config", "", "\tRead the configuration from this file")
+	flag.StringVar(&libraryDirectory, "library", alexandria.DefaultDirectory(), "\tUse the library in this directory")
 	flag.BoolVarP(&index, "index", "i", false, "\tUpdate the index")
+	flag.BoolVar(&jsonOutput, "json", false, "\tPrint the report of 'check' as JSON")
+	flag.BoolVar(&prerender, "prerender", false, "\tRender the scrolls 'watch' finds to have changed")
 	flag.BoolVarP(&stats, "stats", "S", false, "\tPrint some statistics")
 	flag.BoolVarP(&version, "version", "v", false, "\tShow version")
 	flag.BoolVar(&profile, "profile", false, "\tEnable profiler")
 	flag.Parse()
 
-	alexandria.Config.MaxResults = 1e9
+	config := alexandria.NewConfiguration(libraryDirectory)
+	config.MaxResults = 1e9
+	config, err := alexandria.LoadConfiguration(config, configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	*alexandria.Config = config
+
 	if profile {
 		f, err := os.Create("alexandria.prof")
 		if err != nil {
@@ -38,31 +54,133 @@ func main() {
 
 	switch {
 	case index:
-		alexandria.UpdateIndex()
+		updateIndex()
 	case stats:
 		printStats()
 	case version:
 		fmt.Println(alexandria.NAME, alexandria.VERSION)
-	case len(os.Args) <= 1:
+	case flag.NArg() == 0:
 		fmt.Fprintln(os.Stderr, "Nothing to do")
-	case len(os.Args) == 2 && os.Args[1] == "all":
+	case flag.NArg() == 1 && flag.Arg(0) == "all":
 		renderEverything(b)
+	case flag.NArg() == 1 && flag.Arg(0) == "check":
+		checkLibrary(jsonOutput)
+	case flag.NArg() == 1 && flag.Arg(0) == "gc":
+		collectGarbage()
+	case flag.NArg() == 1 && flag.Arg(0) == "watch":
+		watchLibrary(b, prerender)
 	default:
-		i := 1
-		if os.Args[1] == "--" {
-			i++
-		}
-		renderMatchesForQuery(b, strings.Join(os.Args[i:], " "))
+		renderMatchesForQuery(b, strings.Join(flag.Args(), " "))
 	}
 }
 
 func renderEverything(b alexandria.Backend) {
-	numScrolls, errors := b.RenderAllScrolls()
+	numScrolls, errors := b.RenderAllScrolls(context.Background())
 	fmt.Printf("Rendered all %d scrolls.\n", numScrolls)
 	if len(errors) != 0 {
 		printErrors(errors)
+	}
+	if containsFailures(errors) {
+		os.Exit(1)
+	}
+}
+
+func updateIndex() {
+	update, err := alexandria.UpdateIndex()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Added %d, updated %d and removed %d scrolls.\n",
+		update.Added, update.Updated, update.Removed)
+	if update.Garbage.NumFiles > 0 {
+		printGarbageReport(update.Garbage)
+	}
+}
+
+// watchLibrary keeps the index up to date with the library until the process
+// is killed, printing every change.  If prerender is set, the scrolls that
+// were added or modified are rendered right away.
+func watchLibrary(b alexandria.Backend, prerender bool) {
+	updateIndex()
+	ctx := context.Background()
+	err := alexandria.WatchLibrary(ctx, func(update alexandria.IndexUpdate, err error) {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		fmt.Printf("Added %d, updated %d and removed %d scrolls.\n",
+			update.Added, update.Updated, update.Removed)
+		if !prerender || len(update.Changed) == 0 {
+			return
+		}
+		_, errors := b.RenderScrollsByID(ctx, update.Changed)
+		if len(errors) != 0 {
+			printErrors(errors)
+		}
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// collectGarbage deletes unused files from the cache and temp directories.
+func collectGarbage() {
+	report, err := alexandria.CollectGarbage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	printGarbageReport(report)
+}
+
+func printGarbageReport(report alexandria.GarbageReport) {
+	size := float32(report.Size) / 1024.0
+	fmt.Printf("Deleted %d unused files, reclaiming %.1f kiB.\n", report.NumFiles, size)
+}
+
+// Exit codes of the check command
+const (
+	checkPassed = 0
+	checkFailed = 1
+	checkError  = 2
+)
+
+// checkLibrary validates and compiles all scrolls, printing a report in the
+// style of compiler diagnostics or as JSON.  The exit code is non-zero if any
+// errors (but not warnings) were found.
+func checkLibrary(jsonOutput bool) {
+	report, err := alexandria.CheckLibrary(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(checkError)
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(checkError)
+		}
+	} else {
+		for _, problem := range report.Problems {
+			location := string(problem.ID)
+			if problem.Line > 0 {
+				location += ":" + strconv.Itoa(problem.Line)
+			}
+			fmt.Printf("%s: %s: %s\n", location, problem.Severity, problem.Message)
+		}
+		numErrors := report.NumErrors()
+		fmt.Printf("Checked %d scrolls: %d errors, %d warnings.\n", report.NumScrolls,
+			numErrors, len(report.Problems)-numErrors)
+	}
+
+	if report.NumErrors() > 0 {
+		os.Exit(checkFailed)
+	}
+	os.Exit(checkPassed)
 }
 
 func printStats() {
@@ -73,6 +191,8 @@ func printStats() {
 	n := stats.NumberOfScrolls()
 	size := float32(stats.TotalSize()) / 1024.0
 	fmt.Printf("The library contains %v scrolls with a total size of %.1f kiB.\n", n, size)
+	reclaimable := float32(stats.ReclaimableSize()) / 1024.0
+	fmt.Printf("Running 'alexandria gc' would reclaim %.1f kiB.\n", reclaimable)
 }
 
 func renderMatchesForQuery(b alexandria.Backend, query string) {
@@ -80,17 +200,31 @@ func renderMatchesForQuery(b alexandria.Backend, query string) {
 	if err != nil {
 		panic(err)
 	}
-	renderedIDs, errors := b.RenderScrollsByID(ids)
+	renderedIDs, errors := b.RenderScrollsByID(context.Background(), ids)
 	fmt.Printf("There are %d matching scrolls.\n", len(renderedIDs))
 	for _, id := range renderedIDs {
-		fmt.Println("file://" + alexandria.Config.CacheDirectory + string(id) + ".png")
+		for _, path := range alexandria.RenderedFiles(id) {
+			fmt.Println("file://" + path)
+		}
 	}
 	if len(errors) != 0 {
 		printErrors(errors)
+	}
+	if containsFailures(errors) {
 		os.Exit(1)
 	}
 }
 
+// Check whether any of the errors is more than just a warning.
+func containsFailures(errors []error) bool {
+	for _, err := range errors {
+		if !alexandria.IsRenderWarning(err) {
+			return true
+		}
+	}
+	return false
+}
+
 func printErrors(errors []error) {
 	fmt.Fprintf(os.Stderr, "The following errors occurred:\n")
 	for _, err := range errors {
@@ -9,6 +9,9 @@
 package common
 
 import (
+	"context"
+	"os"
+
 	"github.com/pkg/errors"
 )
 
@@ -16,64 +19,77 @@ type Backend interface {
 	// RenderAllScrolls does what it says on the tin: it pre-renders all
 	// scrolls, returning the number of scrolls rendered and an array of
 	// all the errors that occurred in the process.
-	RenderAllScrolls() (numScrolls int, errors []error)
+	RenderAllScrolls(ctx context.Context) (numScrolls int, errors []error)
 
 	// RenderScrollsById renders all the scrolls specified, returning the
 	// IDs of all scrolls that were successfully rendered, and a list of
-	// the errors that were encountered in the process.
-	RenderScrollsByID(ids []ID) (renderedScrollIDs []ID, errors []error)
+	// the errors that were encountered in the process.  Rendering stops
+	// when the context is cancelled.
+	RenderScrollsByID(ctx context.Context, ids []ID) (renderedScrollIDs []ID, errors []error)
 
 	Parse(id, doc string) Scroll
 }
 
-// FindMatchingScrolls asks the storage backend for all scrolls matching the
-// given query. It the IDs of the first of those scrolls, the total number of
-// matches (which can be much greater than the number of IDs returned), and an
-// error, if any occurred.
-func FindMatchingScrolls(query string) ([]ID, int, error) {
-	index, err := OpenExistingIndex()
-	if err != nil {
-		return []ID{}, 0, err
-	}
-	defer index.Close()
-
-	newQuery := translatePlusMinusTildePrefixes(query)
-	searchResults, err := performQuery(index, newQuery)
-	totalMatches := int(searchResults.Total)
-	if err != nil {
-		if err.Error() == "syntax error" {
-			err = errors.Wrapf(err, "invalid query string: '%v'", newQuery)
-		} else {
-			err = errors.Wrap(err, "perform query")
-		}
-		return []ID{}, totalMatches, err
-	}
-
-	var ids []ID
-	for _, match := range searchResults.Hits {
-		id := ID(match.ID)
-		ids = append(ids, id)
-	}
-
-	return ids, totalMatches, nil
+// FormatUser is implemented by backends that keep files in FormatDirectory,
+// e.g. precompiled formats.  CollectGarbage deletes the files there no
+// backend uses.
+type FormatUser interface {
+	// FormatsInUse returns the names of the files in FormatDirectory
+	// needed to render the scrolls with the current templates.
+	FormatsInUse() ([]string, error)
 }
 
-func UpdateIndex(b Backend) error {
-	return updateIndex(b)
+// MetadataChecker is implemented by backends that can run into problems with
+// the metadata of a scroll which Parse can only log, e.g. malformed YAML front
+// matter.  Check reports them as errors.
+type MetadataChecker interface {
+	// ParseAndCheck parses a scroll like Parse, but returns the problems
+	// with its metadata instead of logging them.
+	ParseAndCheck(id, doc string) (Scroll, []error)
 }
 
-func ComputeStatistics() (Statistics, error) {
-	return computeStatistics()
+// ErrNoSuchScroll is the cause of the RenderError reported for a scroll that
+// is no longer in the library, i.e. has been deleted but RemoveFromIndex has
+// not yet been called.
+var ErrNoSuchScroll = errors.New("No such scroll")
+
+// ReadScrollToRender loads the content of a scroll about to be rendered.  If
+// the scroll no longer exists, it is removed from the index.  Any problem is
+// reported as a RenderError.
+func (l *Library) ReadScrollToRender(id ID) (string, error) {
+	doc, err := l.ReadScroll(id)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			TryLogError(l.RemoveFromIndex(id))
+			err = ErrNoSuchScroll
+		}
+		return "", &RenderError{ID: id, Stage: StageTemplate, Err: err}
+	}
+	return doc, nil
 }
 
-func LoadScrolls(b Backend, ids []ID) ([]Scroll, error) {
-	result := make([]Scroll, len(ids))
-	for i, id := range ids {
-		scroll, err := loadAndParseScrollContentByID(b, id)
+// RenderOneByOne renders the given scrolls one after the other using the
+// given function, for backends which cannot do any better.  The function may
+// return a RenderWarning if the scroll was rendered despite some problem, in
+// which case the scroll is included in the rendered IDs, and the warning among
+// the errors.  Rendering stops when the context is cancelled.
+func RenderOneByOne(ctx context.Context, ids []ID, render func(ID) error) (renderedScrollIDs []ID, errs []error) {
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			break
+		}
+		err := render(id)
+		if IsRenderWarning(err) {
+			errs = append(errs, err)
+			err = nil
+		}
 		if err != nil {
-			return result, err
+			LogError(err)
+			errs = append(errs, err)
+		} else {
+			renderedScrollIDs = append(renderedScrollIDs, id)
 		}
-		result[i] = scroll
 	}
-	return result, nil
+	return renderedScrollIDs, errs
 }
@@ -9,19 +9,20 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/blevesearch/bleve"
 	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
 	"github.com/blevesearch/bleve/analysis/analyzer/simple"
+	blevequery "github.com/blevesearch/bleve/search/query"
 	"github.com/pkg/errors"
 )
 
 // Stats contains the size of the library, in number of scrolls and in terms of
 // file size.
 type stats struct {
-	numScrolls int
-	fileSize   int64
+	numScrolls  int
+	fileSize    int64
+	reclaimable int64
 }
 
 // NumberOfScrolls returns the number of scrolls in the library.
@@ -34,80 +35,201 @@ func (s stats) TotalSize() int64 {
 	return s.fileSize
 }
 
+// ReclaimableSize returns the total size of the unused files in the cache and
+// temp directories.
+func (s stats) ReclaimableSize() int64 {
+	return s.reclaimable
+}
+
 // UpdateIndex adds all documents to the index that have been created or
-// modified since the last time this function was executed.
-//
-// Note that this function does *not* remove deleted documents from the index.
-// See `RemoveFromIndex`.
-func updateIndex(b Backend) error {
-	index, isNewIndex, err := openOrCreateIndex()
-	if err != nil {
-		return errors.Wrap(err, "open or create index")
-	}
-	defer index.Close()
-
-	indexUpdateFile := Config.AlexandriaDirectory + "index_updated"
-	timeOfLastIndexUpdate, err := getModTime(indexUpdateFile)
-	// If an error occurs, we just log it. In that case,
-	// timeOfLastIndexUpdate will contain 0, i.e. 1970-01-01. The entire
-	// purpose of the `index_updated` file is to reduce the number of
-	// documents we reindex. Therefore, the worst case scenario when
-	// getModTime fails is that we do some redundant work.
+// modified since the last time this function was executed.  Whether a scroll
+// has been modified is determined by comparing a hash of its content to the
+// one recorded in the manifest, so modification times do not matter.  Each
+// file is parsed by the backend registered for its file extension, files no
+// backend is registered for are skipped.  Documents whose files have been
+// deleted are removed from the index, together with their rendered images.
+func (l *Library) updateIndex(index bleve.Index) (IndexUpdate, error) {
+	var update IndexUpdate
+
+	// If the manifest cannot be read, we just log the error and start
+	// with an empty manifest.  The worst case scenario is that we do some
+	// redundant work by reindexing everything.
+	m, err := l.loadManifest()
 	TryLogError(err)
-	recordIndexUpdateStart(indexUpdateFile)
 
-	files, err := ioutil.ReadDir(Config.KnowledgeDirectory)
+	files, err := ioutil.ReadDir(l.config.KnowledgeDirectory)
+	if err != nil {
+		return update, errors.Wrap(err, "read knowledge directory")
+	}
+
+	indexed, err := indexedIDs(index)
 	if err != nil {
-		return errors.Wrap(err, "read knowledge directory")
+		return update, errors.Wrap(err, "list indexed scrolls")
 	}
 
 	batch := index.NewBatch()
+	present := make(map[ID]bool)
 	for _, file := range files {
-		if !isNewIndex && isOlderThan(file, timeOfLastIndexUpdate) {
+		id, extension, ok := l.splitScrollFileName(file.Name())
+		if !ok {
 			continue
 		}
+		present[id] = true
 
-		id := strings.TrimSuffix(file.Name(), ".tex")
-		scroll, err := loadAndParseScrollContentByID(b, ID(id))
+		changed, err := l.indexScroll(batch, m, id, extension, indexed[id])
 		if err != nil {
 			LogError(err)
 			continue
+		} else if !changed {
+			continue
 		}
-		err = batch.Index(id, scroll)
-		if err != nil {
-			LogError(err)
+		update.Changed = append(update.Changed, id)
+		if indexed[id] {
+			update.Updated++
+		} else {
+			update.Added++
 		}
 	}
-	return index.Batch(batch)
+
+	for id := range indexed {
+		if present[id] {
+			continue
+		}
+		batch.Delete(string(id))
+		l.removeRenderedFiles(id)
+		update.Removed++
+	}
+	for id := range m.Scrolls {
+		if !present[id] {
+			delete(m.Scrolls, id)
+		}
+	}
+
+	err = index.Batch(batch)
+	if err != nil {
+		return update, errors.Wrap(err, "update index")
+	}
+	return update, errors.Wrap(l.saveManifest(m), "save manifest")
 }
 
-func recordIndexUpdateStart(indexUpdateFile string) {
-	err := touch(indexUpdateFile)
+// updateScrolls brings the index up to date with the scrolls with the given
+// IDs, reindexing those that have been created or modified, and removing those
+// that have been deleted, together with their rendered images.
+func (l *Library) updateScrolls(index bleve.Index, ids []ID) (IndexUpdate, error) {
+	var update IndexUpdate
+
+	m, err := l.loadManifest()
 	TryLogError(err)
+
+	batch := index.NewBatch()
+	for _, id := range ids {
+		doc, err := index.Document(string(id))
+		if err != nil {
+			LogError(errors.Wrapf(err, "look up scroll %v", id))
+			continue
+		}
+		indexed := doc != nil
+
+		extension, err := l.findScrollFile(id)
+		if os.IsNotExist(errors.Cause(err)) {
+			if indexed {
+				batch.Delete(string(id))
+				update.Removed++
+			}
+			l.removeRenderedFiles(id)
+			delete(m.Scrolls, id)
+			continue
+		} else if err != nil {
+			LogError(err)
+			continue
+		}
+
+		changed, err := l.indexScroll(batch, m, id, extension, indexed)
+		if err != nil {
+			LogError(err)
+			continue
+		} else if !changed {
+			continue
+		}
+		update.Changed = append(update.Changed, id)
+		if indexed {
+			update.Updated++
+		} else {
+			update.Added++
+		}
+	}
+
+	err = index.Batch(batch)
+	if err != nil {
+		return update, errors.Wrap(err, "update index")
+	}
+	return update, errors.Wrap(l.saveManifest(m), "save manifest")
 }
 
-func touch(file string) error {
-	now := time.Now()
-	return os.Chtimes(file, now, now)
+// Parse the scroll stored in the file with the given extension and add it to
+// the batch, unless it is already indexed and its content hash matches the one
+// in the manifest.  Returns whether the scroll was added to the batch.
+func (l *Library) indexScroll(batch *bleve.Batch, m manifest, id ID, extension string, indexed bool) (bool, error) {
+	content, err := l.readScrollFile(id, extension)
+	if err != nil {
+		return false, err
+	}
+	hash := hashString(content)
+	if indexed && m.Scrolls[id] == hash {
+		return false, nil
+	}
+
+	scroll := l.backends[extension].Parse(string(id), content)
+	err = batch.Index(string(id), scroll)
+	if err != nil {
+		return false, errors.Wrapf(err, "index scroll %v", id)
+	}
+	m.Scrolls[id] = hash
+	return true, nil
 }
 
-func openOrCreateIndex() (bleve.Index, bool, error) {
-	isNewIndex := false
+// indexedIDs returns the set of the IDs of all documents in the index.
+func indexedIDs(index bleve.Index) (map[ID]bool, error) {
+	count, err := index.DocCount()
+	if err != nil {
+		return nil, errors.Wrap(err, "count documents")
+	}
 
-	index, err := OpenExistingIndex()
+	search := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	search.Size = int(count)
+	results, err := index.Search(search)
 	if err != nil {
-		index, err = createNewIndex()
-		isNewIndex = true
+		return nil, err
 	}
 
-	return index, isNewIndex, err
+	ids := make(map[ID]bool, len(results.Hits))
+	for _, match := range results.Hits {
+		ids[ID(match.ID)] = true
+	}
+	return ids, nil
 }
 
-func OpenExistingIndex() (bleve.Index, error) {
-	return bleve.Open(Config.AlexandriaDirectory + "bleve")
+// Open the index, or create a new one if there is none yet.  A new index is
+// empty, so UpdateIndex adds every scroll to it regardless of the manifest.
+// The index is named after the library, so the results of searches across
+// several libraries can be told apart.
+func (l *Library) openOrCreateIndex() (bleve.Index, error) {
+	index, err := bleve.Open(l.indexDirectory())
+	if err != nil {
+		index, err = l.createNewIndex()
+	}
+	if err != nil {
+		return nil, err
+	}
+	index.SetName(l.config.Name)
+	return index, nil
 }
 
-func createNewIndex() (bleve.Index, error) {
+func (l *Library) indexDirectory() string {
+	return l.config.AlexandriaDirectory + "bleve"
+}
+
+func (l *Library) createNewIndex() (bleve.Index, error) {
 	enTextMapping := bleve.NewTextFieldMapping()
 	enTextMapping.Analyzer = "en"
 
@@ -130,35 +252,61 @@ func createNewIndex() (bleve.Index, error) {
 	mapping.DefaultAnalyzer = "en"
 	mapping.DefaultMapping = scrollMapping
 
-	return bleve.New(Config.AlexandriaDirectory+"bleve", mapping)
+	// A library without an index may be new, e.g. just cloned from a
+	// repository, so it may lack a cache directory, too.
+	err := os.MkdirAll(l.config.CacheDirectory, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "create cache directory")
+	}
+	return bleve.New(l.indexDirectory(), mapping)
 }
 
-func isOlderThan(file os.FileInfo, indexUpdateTime int64) bool {
-	modTime, err := getModTime(Config.KnowledgeDirectory + file.Name())
+func (l *Library) loadAndParseScrollContentByID(id ID) (Scroll, error) {
+	extension, err := l.findScrollFile(id)
 	if err != nil {
-		LogError(err)
-		return true
+		return Scroll{}, err
 	}
-	return modTime < indexUpdateTime
+	return l.loadAndParseScrollFile(id, extension)
 }
 
-func loadAndParseScrollContentByID(b Backend, id ID) (Scroll, error) {
-	content, err := ReadScroll(id)
+// Parse the scroll stored in the file with the given extension using the
+// backend registered for that extension.
+func (l *Library) loadAndParseScrollFile(id ID, extension string) (Scroll, error) {
+	content, err := l.readScrollFile(id, extension)
 	if err != nil {
 		return Scroll{}, err
 	}
-	return b.Parse(string(id), content), nil
+	return l.backends[extension].Parse(string(id), content), nil
 }
 
-// RemoveFromIndex removes a specified document from the index. This is
-// necessary as UpdateIndex has no way of knowing if a document was deleted.
-func RemoveFromIndex(id ID) error {
-	index, err := OpenExistingIndex()
+// Find the scrolls matching the query, see FindMatchingScrolls.  The index
+// may be an alias for the indexes of several libraries, each of which is
+// named after its library.  A query consisting of nothing but whitespace
+// matches every scroll.
+func (l *Library) findMatchingScrolls(index bleve.Index, query string) ([]ID, int, error) {
+	var newQuery string
+	var searchQuery blevequery.Query = bleve.NewMatchAllQuery()
+	if strings.TrimSpace(query) != "" {
+		newQuery = translatePlusMinusTildePrefixes(query)
+		searchQuery = bleve.NewQueryStringQuery(newQuery)
+	}
+	searchResults, err := performQuery(index, searchQuery, l.config.MaxResults)
 	if err != nil {
-		return err
+		if err.Error() == "syntax error" {
+			err = errors.Wrapf(err, "invalid query string: '%v'", newQuery)
+		} else {
+			err = errors.Wrap(err, "perform query")
+		}
+		return []ID{}, 0, err
 	}
-	defer index.Close()
-	return index.Delete(string(id))
+
+	var ids []ID
+	for _, match := range searchResults.Hits {
+		id := l.resultID(match.Index, ID(match.ID))
+		ids = append(ids, id)
+	}
+
+	return ids, int(searchResults.Total), nil
 }
 
 func translatePlusMinusTildePrefixes(queryString string) string {
@@ -177,23 +325,17 @@ func translatePlusMinusTildePrefixes(queryString string) string {
 	return newQueryString[1:] // Remove leading space
 }
 
-func performQuery(index bleve.Index, newQueryString string) (*bleve.SearchResult, error) {
-	query := bleve.NewQueryStringQuery(newQueryString)
+func performQuery(index bleve.Index, query blevequery.Query, maxResults int) (*bleve.SearchResult, error) {
 	search := bleve.NewSearchRequest(query)
-	search.Size = Config.MaxResults
+	search.Size = maxResults
 	return index.Search(search)
 }
 
 // computeStatistics counts the number of scrolls in the library and computes
-// their combined size.
-func computeStatistics() (Statistics, error) {
-	index, err := OpenExistingIndex()
-	if err != nil {
-		return stats{}, errors.Wrap(err, "open existing index")
-	}
-	defer index.Close()
-
-	_, size, err := getDirSize(Config.KnowledgeDirectory)
+// their combined size, as well as the size of the files CollectGarbage would
+// delete.
+func (l *Library) computeStatistics(index bleve.Index) (Statistics, error) {
+	_, size, err := getDirSize(l.config.KnowledgeDirectory)
 	if err != nil {
 		return stats{}, errors.Wrap(err, "get size of library directory")
 	}
@@ -203,5 +345,10 @@ func computeStatistics() (Statistics, error) {
 		return stats{}, errors.Wrap(err, "get number of scrolls in the index")
 	}
 
-	return stats{int(num), size}, nil
+	reclaimable, err := l.reclaimableSize()
+	if err != nil {
+		return stats{}, errors.Wrap(err, "find unused files")
+	}
+
+	return stats{int(num), size, reclaimable}, nil
 }
@@ -0,0 +1,45 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CacheKey combines everything that affects the output of rendering a scroll,
+// e.g. the complete LaTeX document and the settings of the renderer, into a
+// single key.  A rendered file can be reused as long as the key is unchanged.
+func CacheKey(parts ...string) string {
+	return hashString(strings.Join(parts, "\x00"))
+}
+
+// The file recording the cache key of the file a scroll was rendered to
+func (l *Library) cacheKeyFile(id ID) string {
+	return l.CacheFile(id, ".key")
+}
+
+// IsCached checks whether the scroll has been rendered to a file with the given
+// extension from input with the given cache key.
+func (l *Library) IsCached(id ID, extension, key string) bool {
+	if len(l.renderedPages(id, extension)) == 0 {
+		return false
+	}
+	recordedKey, err := ioutil.ReadFile(l.cacheKeyFile(id))
+	if err != nil {
+		return false
+	}
+	return string(recordedKey) == key
+}
+
+// RecordCacheKey remembers the cache key of the input a scroll has just been
+// rendered from, so that it is not rendered again until the key changes.
+func (l *Library) RecordCacheKey(id ID, key string) error {
+	err := ioutil.WriteFile(l.cacheKeyFile(id), []byte(key), 0644)
+	return errors.Wrapf(err, "record cache key of %v", id)
+}
@@ -0,0 +1,179 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Severity of a problem found by CheckLibrary
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Problem describes something wrong with a scroll.
+type Problem struct {
+	ID       ID     `json:"id"`
+	Severity string `json:"severity"`
+	// Line is the line of the scroll the problem was found in, or 0 if it
+	// is not known.
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+// CheckReport contains the results of checking the entire library.
+type CheckReport struct {
+	NumScrolls int       `json:"scrolls"`
+	Problems   []Problem `json:"problems"`
+}
+
+// NumErrors counts the problems that are errors rather than warnings.
+func (r CheckReport) NumErrors() int {
+	n := 0
+	for _, problem := range r.Problems {
+		if problem.Severity == SeverityError {
+			n++
+		}
+	}
+	return n
+}
+
+// Check parses every scroll in the library, validates its metadata and
+// compiles it.  Problems with individual scrolls are collected in the report,
+// only problems preventing the check as a whole are returned as errors.
+func (l *Library) Check(ctx context.Context) (CheckReport, error) {
+	report := CheckReport{Problems: []Problem{}}
+
+	ids, err := l.allScrollIDs()
+	if err != nil {
+		return report, err
+	}
+	report.NumScrolls = len(ids)
+
+	knownTypes := l.KnownTypes()
+	var parsedIDs []ID
+	for _, id := range ids {
+		problems, err := l.checkScroll(id, knownTypes)
+		if err != nil {
+			report.Problems = append(report.Problems, Problem{ID: id,
+				Severity: SeverityError, Message: err.Error()})
+			continue
+		}
+		report.Problems = append(report.Problems, problems...)
+		parsedIDs = append(parsedIDs, id)
+	}
+
+	reported := make(map[Problem]bool)
+	for _, problem := range report.Problems {
+		reported[problem] = true
+	}
+	_, errs := l.RenderScrollsByID(ctx, parsedIDs)
+	for _, err := range errs {
+		// Warnings about the type are reported by both checkMetadata
+		// and the backend.
+		problem := renderProblem(err)
+		if !reported[problem] {
+			report.Problems = append(report.Problems, problem)
+		}
+	}
+
+	sort.SliceStable(report.Problems, func(i, j int) bool {
+		a, b := report.Problems[i], report.Problems[j]
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		return a.Line < b.Line
+	})
+	return report, nil
+}
+
+// Turn an error that occurred while rendering into a problem report.
+func renderProblem(err error) Problem {
+	var warning *RenderWarning
+	if errors.As(err, &warning) {
+		return Problem{ID: warning.ID, Severity: SeverityWarning, Message: warning.Message}
+	}
+
+	var renderError *RenderError
+	if !errors.As(err, &renderError) {
+		return Problem{Severity: SeverityError, Message: err.Error()}
+	}
+
+	message := renderError.Message
+	if message == "" && renderError.Err != nil {
+		message = renderError.Err.Error()
+	}
+	return Problem{ID: renderError.ID, Severity: SeverityError,
+		Line: renderError.Line, Message: string(renderError.Stage) + ": " + message}
+}
+
+// Parse a scroll and look for problems with its metadata, both those its
+// backend finds, see MetadataChecker, and those checkMetadata finds.
+func (l *Library) checkScroll(id ID, knownTypes map[string]bool) ([]Problem, error) {
+	extension, err := l.findScrollFile(id)
+	if err != nil {
+		return nil, err
+	}
+	content, err := l.readScrollFile(id, extension)
+	if err != nil {
+		return nil, err
+	}
+
+	var scroll Scroll
+	var errs []error
+	backend := l.backends[extension]
+	if checker, ok := backend.(MetadataChecker); ok {
+		scroll, errs = checker.ParseAndCheck(string(id), content)
+	} else {
+		scroll = backend.Parse(string(id), content)
+	}
+
+	var problems []Problem
+	for _, err := range errs {
+		problems = append(problems, Problem{ID: id, Severity: SeverityError,
+			Message: err.Error()})
+	}
+	return append(problems, checkMetadata(scroll, knownTypes)...), nil
+}
+
+// checkMetadata looks for problems with the metadata of a scroll: missing or
+// unknown types, for which the fallback template is used, malformed metadata
+// lines and duplicate tags.  The known types are those returned by
+// KnownTypes.
+func checkMetadata(scroll Scroll, knownTypes map[string]bool) []Problem {
+	var problems []Problem
+	report := func(severity, message string) {
+		problems = append(problems, Problem{ID: scroll.ID, Severity: severity, Message: message})
+	}
+
+	if scroll.Type == "" {
+		report(SeverityWarning, "no @type given, using the fallback template")
+	} else if !knownTypes[scroll.Type] {
+		report(SeverityWarning, "unknown @type '"+scroll.Type+"', using the fallback template")
+	}
+
+	for _, line := range scroll.OtherLines {
+		keyword := strings.Fields(line)[0]
+		if strings.HasPrefix(keyword, "@source") || strings.HasPrefix(keyword, "@type") {
+			report(SeverityWarning, "malformed metadata line '"+line+"'")
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, tag := range append(append([]string{}, scroll.Tags...), scroll.Hidden...) {
+		key := strings.ToLower(tag)
+		if seen[key] {
+			report(SeverityWarning, "duplicate tag '"+tag+"'")
+		}
+		seen[key] = true
+	}
+
+	return problems
+}
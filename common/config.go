@@ -9,22 +9,66 @@
 package common
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
 )
 
-// Config holds all the configuration of Alexandria.
-var Config = initConfig()
+// Prefix of the environment variables overriding the configuration
+const envPrefix = "ALEXANDRIA_"
+
+// The values Config.Renderer may be set to, i.e. the supported TeX engines
+var renderers = []string{"xelatex", "pdflatex", "lualatex", "tectonic"}
+
+// The values Config.ImageFormat may be set to
+var imageFormats = []string{"png", "svg"}
+
+// Config holds the configuration of the default library, see DefaultLibrary.
+var Config = NewConfiguration(DefaultDirectory())
 
-func initConfig() Configuration {
+// DefaultDirectory returns the directory the library is stored in unless
+// another one is chosen explicitly: $ALEXANDRIA_LIBRARY if it is set, and
+// ~/.alexandria/ otherwise.
+func DefaultDirectory() string {
+	if dir := os.Getenv(envPrefix + "LIBRARY"); dir != "" {
+		return dir
+	}
+	return os.Getenv("HOME") + "/.alexandria/"
+}
+
+// NewConfiguration returns the default configuration of a library stored in
+// the given directory.
+func NewConfiguration(dir string) Configuration {
 	var config Configuration
 
+	config.Renderer = "xelatex"
+	config.ImageFormat = "png"
 	config.Quality = 90
 	config.Dpi = 160
 	config.MaxResults = 1000
+	config.PageSize = 20
+	config.ListenAddress = "127.0.0.1:41665"
 	config.MaxProcs = 4
+	config.Name = "default"
+	config.RenderTimeout = 30 * time.Second
 
-	dir := os.Getenv("HOME") + "/.alexandria/"
+	config.TypeAliases = map[string]string{
+		"cor":  "corollary",
+		"def":  "definition",
+		"ex":   "example",
+		"lem":  "lemma",
+		"prop": "proposition",
+		"rem":  "remark",
+		"thm":  "theorem",
+	}
 
+	dir = asDirectory(dir)
 	config.AlexandriaDirectory = dir
 	config.KnowledgeDirectory = dir + "library/"
 	config.CacheDirectory = dir + "cache/"
@@ -33,3 +77,165 @@ func initConfig() Configuration {
 
 	return config
 }
+
+// LoadConfiguration reads the given YAML file, e.g.
+//
+//	renderer: lualatex
+//	page_size: 50
+//	listen_address: 127.0.0.1:8080
+//	template_directory: ~/latex/alexandria
+//	libraries:
+//	  shared: ~/git/shared-library
+//
+// and applies the settings it contains to config.  If file is empty,
+// $ALEXANDRIA_CONFIG is read, or config.yaml in the library's directory if
+// it exists.  Each setting may in turn be overridden by an environment
+// variable named after its key, e.g. ALEXANDRIA_PAGE_SIZE.  Type aliases and
+// libraries are added to the existing ones rather than replacing them.
+// Relative directories are taken to be relative to the library's directory.
+// Unknown renderers and image formats as well as render timeouts shorter than
+// a second are rejected.
+func LoadConfiguration(config Configuration, file string) (Configuration, error) {
+	if file == "" {
+		file = os.Getenv(envPrefix + "CONFIG")
+	}
+	optional := file == ""
+	if optional {
+		file = config.AlexandriaDirectory + "config.yaml"
+	}
+	err := config.load(file, optional, true)
+	return config, err
+}
+
+// Configuration of the library in the given directory when it is searched
+// together with another library under the given name.  Its own configuration
+// file is read, but neither the environment nor the libraries it would search
+// are taken into account.
+func memberConfiguration(name, dir string) Configuration {
+	config := NewConfiguration(dir)
+	TryLogError(config.load(config.AlexandriaDirectory+"config.yaml", true, false))
+	config.Name = name
+	config.Libraries = nil
+	return config
+}
+
+// Apply the settings from the given file and, if useEnvironment is set, the
+// environment, see LoadConfiguration.  If optional is set, it is not an
+// error for the file not to exist.
+func (config *Configuration) load(file string, optional, useEnvironment bool) error {
+	// Collect the entries of the maps separately, as the YAML decoder
+	// rejects keys that are already in a map.  This also keeps the maps
+	// of the configuration passed to LoadConfiguration unchanged.
+	aliases := make(map[string]string, len(config.TypeAliases))
+	libraries := make(map[string]string, len(config.Libraries))
+	collectMaps := func() {
+		for alias, scrollType := range config.TypeAliases {
+			aliases[alias] = scrollType
+		}
+		for name, dir := range config.Libraries {
+			libraries[name] = dir
+		}
+		config.TypeAliases, config.Libraries = nil, nil
+	}
+	collectMaps()
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil && !(optional && os.IsNotExist(err)) {
+		return errors.Wrap(err, "read configuration file")
+	}
+	err = yaml.UnmarshalStrict(content, config)
+	if err != nil {
+		return errors.Wrapf(err, "parse %v", file)
+	}
+	collectMaps()
+
+	if useEnvironment {
+		err = applyEnvironment(config)
+		if err != nil {
+			return err
+		}
+		collectMaps()
+	}
+	config.TypeAliases = aliases
+
+	for _, dir := range []*string{&config.KnowledgeDirectory, &config.CacheDirectory,
+		&config.TemplateDirectory, &config.TempDirectory} {
+		*dir = config.resolveDirectory(*dir)
+	}
+	for name, dir := range libraries {
+		libraries[name] = config.resolveDirectory(dir)
+	}
+	config.Libraries = libraries
+	return config.validate()
+}
+
+// Check the settings that can only take a few different values or are
+// easily given in the wrong unit.
+func (config Configuration) validate() error {
+	if !contains(renderers, config.Renderer) {
+		return errors.Errorf("unknown renderer '%v', expected one of %v",
+			config.Renderer, strings.Join(renderers, ", "))
+	}
+	if !contains(imageFormats, config.ImageFormat) {
+		return errors.Errorf("unknown image format '%v', expected one of %v",
+			config.ImageFormat, strings.Join(imageFormats, ", "))
+	}
+	// A number without a unit is read as nanoseconds, which is surely a
+	// mistake.
+	if config.RenderTimeout > 0 && config.RenderTimeout < time.Second {
+		return errors.Errorf("render timeout %v is too short, did you mean %vs?",
+			config.RenderTimeout, int64(config.RenderTimeout))
+	}
+	return nil
+}
+
+// Check whether the given value is in the list.
+func contains(list []string, value string) bool {
+	for _, x := range list {
+		if x == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Override the settings for which an environment variable is set, parsing
+// its value just like a value in the configuration file.
+func applyEnvironment(config *Configuration) error {
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := envPrefix + strings.ToUpper(key)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		err := yaml.UnmarshalStrict([]byte(value), v.Field(i).Addr().Interface())
+		if err != nil {
+			return errors.Wrapf(err, "parse %v", name)
+		}
+	}
+	return nil
+}
+
+// Expand a leading ~ and make the given directory relative to the library's
+// directory, if it is not absolute.
+func (config Configuration) resolveDirectory(dir string) string {
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		dir = os.Getenv("HOME") + dir[1:]
+	} else if !filepath.IsAbs(dir) {
+		dir = config.AlexandriaDirectory + dir
+	}
+	return asDirectory(dir)
+}
+
+// Add the trailing slash the paths of directories are expected to end in.
+func asDirectory(dir string) string {
+	if strings.HasSuffix(dir, "/") {
+		return dir
+	}
+	return dir + "/"
+}
@@ -0,0 +1,238 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Remove the environment variables configuring Alexandria and set the given
+// ones, e.g. HOME, for the duration of the test.
+func setEnvironment(t *testing.T, env map[string]string) {
+	saved := os.Environ()
+	t.Cleanup(func() {
+		os.Clearenv()
+		for _, entry := range saved {
+			kv := strings.SplitN(entry, "=", 2)
+			os.Setenv(kv[0], kv[1])
+		}
+	})
+	for _, entry := range saved {
+		key := strings.SplitN(entry, "=", 2)[0]
+		if strings.HasPrefix(key, envPrefix) {
+			os.Unsetenv(key)
+		}
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+	}
+}
+
+func TestLoadConfiguration(t *testing.T) {
+	const home = "/home/user"
+	tests := []struct {
+		name string
+		// The content of config.yaml in the library's directory, if any
+		file string
+		env  map[string]string
+		// Modify the default configuration into the expected one.
+		want func(c *Configuration)
+		// A substring of the expected error, if any
+		err string
+	}{
+		{
+			name: "defaults",
+			want: func(c *Configuration) {},
+		},
+		{
+			name: "file",
+			file: "renderer: lualatex\npage_size: 50\nrender_timeout: 1m\ncollect_garbage: true\n",
+			want: func(c *Configuration) {
+				c.Renderer = "lualatex"
+				c.PageSize = 50
+				c.RenderTimeout = time.Minute
+				c.CollectGarbage = true
+			},
+		},
+		{
+			name: "environment overrides file",
+			file: "page_size: 50\nimage_format: svg\n",
+			env:  map[string]string{"ALEXANDRIA_PAGE_SIZE": "30", "ALEXANDRIA_MAX_PROCS": "1"},
+			want: func(c *Configuration) {
+				c.PageSize = 30
+				c.MaxProcs = 1
+				c.ImageFormat = "svg"
+			},
+		},
+		{
+			name: "type aliases are added",
+			file: "type_aliases: {conj: conjecture}\n",
+			env:  map[string]string{"ALEXANDRIA_TYPE_ALIASES": "{lem: lemma, ax: axiom}"},
+			want: func(c *Configuration) {
+				c.TypeAliases["conj"] = "conjecture"
+				c.TypeAliases["ax"] = "axiom"
+			},
+		},
+		{
+			name: "relative directories",
+			file: "template_directory: tpl\ncache_directory: ~/cache\ntemp_directory: /var/tmp/alexandria\n" +
+				"libraries: {shared: ../shared, notes: ~/notes}\n",
+			want: func(c *Configuration) {
+				c.TemplateDirectory = c.AlexandriaDirectory + "tpl/"
+				c.CacheDirectory = home + "/cache/"
+				c.TempDirectory = "/var/tmp/alexandria/"
+				c.Libraries = map[string]string{
+					"shared": c.AlexandriaDirectory + "../shared/",
+					"notes":  home + "/notes/",
+				}
+			},
+		},
+		{
+			name: "unknown key",
+			file: "page_sise: 50\n",
+			err:  "field page_sise not found",
+		},
+		{
+			name: "wrong type",
+			file: "page_size: many\n",
+			err:  "cannot unmarshal",
+		},
+		{
+			name: "invalid environment variable",
+			env:  map[string]string{"ALEXANDRIA_MAX_PROCS": "all"},
+			err:  "parse ALEXANDRIA_MAX_PROCS",
+		},
+		{
+			name: "unknown renderer",
+			env:  map[string]string{"ALEXANDRIA_RENDERER": "xetex"},
+			err:  "unknown renderer 'xetex'",
+		},
+		{
+			name: "timeout without a unit",
+			file: "render_timeout: 30\n",
+			err:  "render timeout 30ns is too short, did you mean 30s?",
+		},
+		{
+			name: "timeout without a unit in the environment",
+			env:  map[string]string{"ALEXANDRIA_RENDER_TIMEOUT": "30"},
+			err:  "render timeout 30ns is too short",
+		},
+		{
+			name: "no timeout",
+			file: "render_timeout: 0\n",
+			want: func(c *Configuration) {
+				c.RenderTimeout = 0
+			},
+		},
+		{
+			name: "unknown image format",
+			file: "image_format: jpg\n",
+			err:  "unknown image format 'jpg'",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir() + "/"
+			env := map[string]string{"HOME": home}
+			for key, value := range test.env {
+				env[key] = value
+			}
+			setEnvironment(t, env)
+			if test.file != "" {
+				err := ioutil.WriteFile(dir+"config.yaml", []byte(test.file), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			config, err := LoadConfiguration(NewConfiguration(dir), "")
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := NewConfiguration(dir)
+			want.Libraries = map[string]string{}
+			test.want(&want)
+			if !reflect.DeepEqual(config, want) {
+				t.Errorf("got %+v, expected %+v", config, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigurationFile(t *testing.T) {
+	dir := t.TempDir() + "/"
+	file := dir + "other.yaml"
+	err := ioutil.WriteFile(file, []byte("page_size: 7\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		pageSize int
+		err      bool
+	}{
+		{name: "explicit file", file: file, pageSize: 7},
+		{name: "file from the environment", env: map[string]string{"ALEXANDRIA_CONFIG": file}, pageSize: 7},
+		{name: "explicit file wins", file: file, env: map[string]string{"ALEXANDRIA_CONFIG": dir + "missing.yaml"}, pageSize: 7},
+		{name: "missing explicit file", file: dir + "missing.yaml", err: true},
+		{name: "missing file from the environment", env: map[string]string{"ALEXANDRIA_CONFIG": dir + "missing.yaml"}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setEnvironment(t, test.env)
+			config, err := LoadConfiguration(NewConfiguration(dir), test.file)
+			if test.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.PageSize != test.pageSize {
+				t.Errorf("page size %d, expected %d", config.PageSize, test.pageSize)
+			}
+		})
+	}
+}
+
+func TestResolveDirectory(t *testing.T) {
+	setEnvironment(t, map[string]string{"HOME": "/home/user"})
+	config := NewConfiguration("/lib")
+	tests := []struct {
+		dir, want string
+	}{
+		{"cache", "/lib/cache/"},
+		{"cache/", "/lib/cache/"},
+		{"../shared", "/lib/../shared/"},
+		{"/var/cache", "/var/cache/"},
+		{"~", "/home/user/"},
+		{"~/alexandria", "/home/user/alexandria/"},
+		{"~other/alexandria", "/lib/~other/alexandria/"},
+	}
+	for _, test := range tests {
+		got := config.resolveDirectory(test.dir)
+		if got != test.want {
+			t.Errorf("resolveDirectory(%q) = %q, expected %q", test.dir, got, test.want)
+		}
+	}
+}
@@ -8,6 +8,10 @@
 
 package common
 
+import (
+	"time"
+)
+
 // ID holds UUID identifying a scroll.
 type ID string
 
@@ -15,31 +19,87 @@ type ID string
 type Statistics interface {
 	NumberOfScrolls() int
 	TotalSize() int64
+	// ReclaimableSize is the combined size of the unused files
+	// CollectGarbage would delete.
+	ReclaimableSize() int64
+}
+
+// IndexUpdate describes the changes UpdateIndex made to the index.
+type IndexUpdate struct {
+	// Number of scrolls added to the index
+	Added int
+	// Number of scrolls that were reindexed as they might have changed
+	Updated int
+	// Number of scrolls removed from the index as they have been deleted
+	Removed int
+	// The IDs of the scrolls added or updated
+	Changed []ID
+	// The unused files deleted after updating the index, if
+	// Config.CollectGarbage is set
+	Garbage GarbageReport
 }
 
-// Configuration data of Alexandria
+// Configuration data of Alexandria.  The keys used for each setting in the
+// configuration file, see LoadConfiguration, are given by the yaml tags.
 type Configuration struct {
+	// The TeX engine used to compile LaTeX scrolls: "xelatex",
+	// "pdflatex", "lualatex" or "tectonic"
+	Renderer string `yaml:"renderer"`
+	// The format of the images LaTeX scrolls are rendered to, either
+	// "png" or "svg"
+	ImageFormat string `yaml:"image_format"`
+	// Render LaTeX scrolls to HTML, leaving the maths to the browser,
+	// rather than compiling them to images.  This is also done when
+	// the TeX engine is not installed.
+	RenderLatexToHTML bool `yaml:"render_latex_to_html"`
 	// The setting passed to ImageMagick when generating the PNG files
-	Quality int
+	Quality int `yaml:"quality"`
 	// The resolution of the generated PNG files
-	Dpi int
+	Dpi int `yaml:"dpi"`
 	// How many processes may run in parallel when rendering
-	MaxProcs int
+	MaxProcs int `yaml:"max_procs"`
+	// How long rendering a single scroll may take before TeX is killed,
+	// or 0 for no limit
+	RenderTimeout time.Duration `yaml:"render_timeout"`
 
 	// How many results are to be processed at once
-	MaxResults int
+	MaxResults int `yaml:"max_results"`
+	// How many results the web interface shows at once
+	PageSize int `yaml:"page_size"`
+	// The address the web interface listens on
+	ListenAddress string `yaml:"listen_address"`
+
+	// Delete unused files from the cache and temp directories whenever
+	// the index is updated
+	CollectGarbage bool `yaml:"collect_garbage"`
+
+	// Abbreviations that may be used in place of the full name of a
+	// scroll type, e.g. "lem" for "lemma"
+	TypeAliases map[string]string `yaml:"type_aliases"`
+
+	// The name of the library, used to tell its scrolls apart from those
+	// of the other libraries searched together with it
+	Name string `yaml:"name"`
+	// The other libraries searched together with this one, mapping their
+	// names to the directories they are stored in
+	Libraries map[string]string `yaml:"libraries"`
 
-	AlexandriaDirectory string
-	KnowledgeDirectory  string
-	CacheDirectory      string
-	TemplateDirectory   string
-	TempDirectory       string
+	// The directory holding the index, the configuration file and, by
+	// default, the directories below
+	AlexandriaDirectory string `yaml:"-"`
+	KnowledgeDirectory  string `yaml:"library_directory"`
+	CacheDirectory      string `yaml:"cache_directory"`
+	TemplateDirectory   string `yaml:"template_directory"`
+	TempDirectory       string `yaml:"temp_directory"`
 }
 
 // Scroll contains all the data contained in a document.
 type Scroll struct {
 	ID      ID     `json:"id"`
 	Content string `json:"content"`
+	// Library is the name of the library the scroll belongs to.  It is
+	// set by LoadScrolls, but not stored in the index.
+	Library string `json:"-"`
 	// Type is the type of document we are dealing with.  This might be
 	// something 'definition', 'lemma', etc.  It is used to select the
 	// appropriate template when rendering.
@@ -48,4 +108,10 @@ type Scroll struct {
 	Tags        []string `json:"tag"`
 	Hidden      []string `json:"hidden"`
 	OtherLines  []string `json:"other"`
+	// ContentLines maps each line of Content to the line of the file the
+	// scroll is stored in it comes from, counting from 1, so that errors
+	// can be reported in terms of the latter.  It is set by backends
+	// removing parts of a scroll from its content, but not stored in the
+	// index.
+	ContentLines []int `json:"-"`
 }
@@ -0,0 +1,103 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The extension of the files recording why a scroll could not be rendered
+const failureExtension = ".failure"
+
+// The number of lines of the TeX output kept when recording a failure
+const failureLogLines = 30
+
+// The file recording the last failure to render a scroll
+type failureRecord struct {
+	// Key is the cache key of the input the scroll failed to render from,
+	// see failureKey.
+	Key     string      `json:"key"`
+	Stage   RenderStage `json:"stage"`
+	Line    int         `json:"line,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Timeout bool        `json:"timeout,omitempty"`
+	// Log is the end of the underlying error message, usually including
+	// the output of TeX.
+	Log string `json:"log"`
+}
+
+func (l *Library) failureFile(id ID) string {
+	return l.CacheFile(id, failureExtension)
+}
+
+// The key a failure is recorded under: the cache key of the input together
+// with the render timeout, so that a scroll that timed out is rendered again
+// once the timeout is changed.
+func (l *Library) failureKey(key string) string {
+	return CacheKey(key, l.config.RenderTimeout.String())
+}
+
+// RecordFailure remembers that the scroll could not be rendered from input
+// with the given cache key, so that it is not rendered again in vain until
+// the scroll, the templates or the settings, including the render timeout,
+// change.  Failures caused by rendering being cancelled are not recorded, as
+// they say nothing about the scroll.
+func (l *Library) RecordFailure(key string, renderError *RenderError) error {
+	if errors.Is(renderError, context.Canceled) {
+		return nil
+	}
+	record := failureRecord{Key: l.failureKey(key), Stage: renderError.Stage, Line: renderError.Line,
+		Message: renderError.Message, Timeout: IsRenderTimeout(renderError)}
+	if renderError.Err != nil {
+		lines := strings.Split(renderError.Err.Error(), "\n")
+		if len(lines) > failureLogLines {
+			lines = lines[len(lines)-failureLogLines:]
+		}
+		record.Log = strings.Join(lines, "\n")
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrapf(err, "encode failure of %v", renderError.ID)
+	}
+	err = ioutil.WriteFile(l.failureFile(renderError.ID), data, 0644)
+	return errors.Wrapf(err, "record failure of %v", renderError.ID)
+}
+
+// RecordedFailure returns the error recorded by RecordFailure if the scroll
+// failed to render from input with the given cache key, or nil otherwise.
+func (l *Library) RecordedFailure(id ID, key string) *RenderError {
+	data, err := ioutil.ReadFile(l.failureFile(id))
+	if err != nil {
+		return nil
+	}
+	var record failureRecord
+	if json.Unmarshal(data, &record) != nil || record.Key != l.failureKey(key) {
+		return nil
+	}
+
+	renderError := &RenderError{ID: id, Stage: record.Stage, Line: record.Line,
+		Message: record.Message, Err: errors.New(record.Log)}
+	if record.Timeout {
+		renderError.Err = errors.Wrap(ErrRenderTimeout, record.Log)
+	}
+	return renderError
+}
+
+// ClearFailure forgets the failure recorded for the scroll, if any, e.g.
+// because it has been rendered successfully.
+func (l *Library) ClearFailure(id ID) {
+	err := os.Remove(l.failureFile(id))
+	if !os.IsNotExist(err) {
+		TryLogError(err)
+	}
+}
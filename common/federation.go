@@ -0,0 +1,130 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// librarySeparator separates the name of a library from the ID of one of its
+// scrolls when it is searched together with another library.  Scroll IDs are
+// file names, so they cannot contain it.
+const librarySeparator = "/"
+
+// Prefix the ID of a scroll with the name of the library it belongs to.
+func qualifiedID(library string, id ID) ID {
+	return ID(library + librarySeparator + string(id))
+}
+
+// Find the library the scroll with the given ID, as returned by
+// FindMatchingScrolls, belongs to and its ID within that library.
+func (l *Library) resolveID(id ID) (*Library, ID) {
+	i := strings.Index(string(id), librarySeparator)
+	if i < 0 {
+		return l, id
+	}
+	if member, ok := l.members[string(id[:i])]; ok {
+		return member, id[i+len(librarySeparator):]
+	}
+	return l, id
+}
+
+// Get the ID of a search result in the index of the library with the given
+// name.
+func (l *Library) resultID(library string, id ID) ID {
+	if library == l.config.Name {
+		return id
+	}
+	return qualifiedID(library, id)
+}
+
+// Find this library or one of the libraries searched together with it by
+// name.
+func (l *Library) libraryByName(name string) (*Library, bool) {
+	if name == l.config.Name {
+		return l, true
+	}
+	member, ok := l.members[name]
+	return member, ok
+}
+
+// Remove the library:name terms from a query, returning the remaining query
+// and the libraries to search: those named in library:name terms, if there
+// are any, or else all of them, except for those named in -library:name
+// terms.
+func (l *Library) selectLibraries(query string) (string, []*Library, error) {
+	included := make(map[*Library]bool)
+	excluded := make(map[*Library]bool)
+	var words []string
+	for _, word := range strings.Fields(query) {
+		prefix, term := "", word
+		if strings.ContainsAny(word[:1], "+-~") {
+			prefix, term = word[:1], word[1:]
+		}
+		if !strings.HasPrefix(term, "library:") {
+			words = append(words, word)
+			continue
+		}
+
+		name := strings.Trim(strings.TrimPrefix(term, "library:"), `"`)
+		library, ok := l.libraryByName(name)
+		if !ok {
+			return "", nil, errors.Errorf("unknown library '%v'", name)
+		}
+		if prefix == "-" {
+			excluded[library] = true
+		} else {
+			included[library] = true
+		}
+	}
+
+	libraries := []*Library{l}
+	var names []string
+	for name := range l.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		libraries = append(libraries, l.members[name])
+	}
+
+	var selected []*Library
+	for _, library := range libraries {
+		if (len(included) == 0 || included[library]) && !excluded[library] {
+			selected = append(selected, library)
+		}
+	}
+	return strings.Join(words, " "), selected, nil
+}
+
+// Add the changes made to the index of the library with the given name.
+func (u *IndexUpdate) add(library string, other IndexUpdate) {
+	u.Added += other.Added
+	u.Updated += other.Updated
+	u.Removed += other.Removed
+	for _, id := range other.Changed {
+		u.Changed = append(u.Changed, qualifiedID(library, id))
+	}
+	u.Garbage.NumFiles += other.Garbage.NumFiles
+	u.Garbage.Size += other.Garbage.Size
+}
+
+// Prefix the IDs of the scrolls in the errors reported by the library with
+// the given name, so they match the IDs returned by FindMatchingScrolls.
+func qualifyErrors(library string, errs []error) {
+	for _, err := range errs {
+		var renderError *RenderError
+		var warning *RenderWarning
+		if errors.As(err, &renderError) {
+			renderError.ID = qualifiedID(library, renderError.ID)
+		} else if errors.As(err, &warning) {
+			warning.ID = qualifiedID(library, warning.ID)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Create a library searched together with the libraries "shared" and "team".
+func newFederation(t *testing.T) *Library {
+	config := NewConfiguration(t.TempDir())
+	config.Libraries = map[string]string{"shared": t.TempDir(), "team": t.TempDir()}
+	return NewLibrary(config)
+}
+
+func TestSelectLibraries(t *testing.T) {
+	l := newFederation(t)
+	tests := []struct {
+		query     string
+		want      string
+		libraries []string
+		err       bool
+	}{
+		{query: "zariski", want: "zariski", libraries: []string{"default", "shared", "team"}},
+		{query: "zariski library:shared", want: "zariski", libraries: []string{"shared"}},
+		{query: `library:"shared" zariski`, want: "zariski", libraries: []string{"shared"}},
+		{query: "+library:team zariski", want: "zariski", libraries: []string{"team"}},
+		{query: "library:team library:default zariski", want: "zariski", libraries: []string{"default", "team"}},
+		{query: "-library:team zariski", want: "zariski", libraries: []string{"default", "shared"}},
+		{query: "library:shared -library:shared", want: "", libraries: nil},
+		{query: "tag:topology -compact ~closed", want: "tag:topology -compact ~closed",
+			libraries: []string{"default", "shared", "team"}},
+		{query: "zariski library:nope", err: true},
+		{query: "-library:nope", err: true},
+	}
+	for _, test := range tests {
+		query, libraries, err := l.selectLibraries(test.query)
+		if test.err {
+			if err == nil {
+				t.Errorf("selectLibraries(%q): expected an error", test.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("selectLibraries(%q): %v", test.query, err)
+			continue
+		}
+		var names []string
+		for _, library := range libraries {
+			names = append(names, library.config.Name)
+		}
+		if query != test.want || !reflect.DeepEqual(names, test.libraries) {
+			t.Errorf("selectLibraries(%q) = %q, %v, expected %q, %v",
+				test.query, query, names, test.want, test.libraries)
+		}
+	}
+}
+
+func TestResolveID(t *testing.T) {
+	l := newFederation(t)
+	tests := []struct {
+		id      ID
+		library string
+		want    ID
+	}{
+		{"zariski", "default", "zariski"},
+		{"shared/zariski", "shared", "zariski"},
+		{"team/a/b", "team", "a/b"},
+		{"default/zariski", "default", "default/zariski"},
+		{"unknown/zariski", "default", "unknown/zariski"},
+		{"/zariski", "default", "/zariski"},
+	}
+	for _, test := range tests {
+		library, id := l.resolveID(test.id)
+		if library.config.Name != test.library || id != test.want {
+			t.Errorf("resolveID(%q) = %v, %q, expected %v, %q",
+				test.id, library.config.Name, id, test.library, test.want)
+		}
+	}
+}
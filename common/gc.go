@@ -0,0 +1,242 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GarbageReport describes the unused files found in the cache and temp
+// directories.
+type GarbageReport struct {
+	// Number of files
+	NumFiles int
+	// Combined size of the files in bytes
+	Size int64
+}
+
+// Files in the temp directory are only considered garbage once they have not
+// been modified for this long, so the files of renders in progress are left
+// alone.
+const staleAfter = time.Hour
+
+// The extensions of the intermediate files the backends leave in their work
+// directories, and older versions left in the temp directory itself.  Other
+// files in the temp directory are left alone, in case it is shared with other
+// programs.
+var intermediateExtensions = []string{".tex", ".log", ".aux", ".out", ".pdf", ".dvi", ".xdv", ".fmt"}
+
+// The page number at the end of the names of the images of a scroll spanning
+// several pages, see PageFile
+var pageSuffixPattern = regexp.MustCompile(`^(.*)-\d+$`)
+
+// CollectGarbage deletes the files that are no longer needed: the files in
+// the cache directory belonging to scrolls that no longer exist, the stale
+// intermediate files in the temp directory and the work directories, which
+// are kept after a render fails, and the precompiled formats that no longer match the templates.
+func (l *Library) CollectGarbage() (GarbageReport, error) {
+	var report GarbageReport
+	garbage, err := l.findGarbage()
+	if err != nil {
+		return report, err
+	}
+	for _, file := range garbage {
+		err := os.Remove(file.path)
+		if err != nil && !os.IsNotExist(err) {
+			LogError(err)
+			continue
+		}
+		report.NumFiles++
+		report.Size += file.size
+	}
+
+	// Remove the work directories that are empty now.
+	dirs, err := l.workDirectories()
+	if err != nil {
+		return report, err
+	}
+	for _, dir := range dirs {
+		// This fails if there are files left.
+		_ = os.Remove(dir)
+	}
+	return report, nil
+}
+
+type garbageFile struct {
+	path string
+	size int64
+}
+
+// Find all the files CollectGarbage would delete.
+func (l *Library) findGarbage() ([]garbageFile, error) {
+	var garbage []garbageFile
+
+	ids, err := l.allScrollIDs()
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[ID]bool)
+	for _, id := range ids {
+		exists[id] = true
+	}
+
+	files, err := ioutil.ReadDir(l.config.CacheDirectory)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "read cache directory")
+	}
+	for _, file := range files {
+		if file.Mode().IsRegular() && isRenderedFile(file.Name()) &&
+			!belongsToScroll(file.Name(), exists) {
+			garbage = append(garbage, garbageFile{l.config.CacheDirectory + file.Name(), file.Size()})
+		}
+	}
+
+	// Older versions compiled the scrolls in the temp directory itself.
+	stale, err := staleIntermediateFiles(l.config.TempDirectory)
+	if err != nil {
+		return nil, err
+	}
+	garbage = append(garbage, stale...)
+
+	dirs, err := l.workDirectories()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		stale, err := staleIntermediateFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		garbage = append(garbage, stale...)
+	}
+
+	formats, err := l.unusedFormats()
+	if err != nil {
+		return nil, err
+	}
+	garbage = append(garbage, formats...)
+
+	// Older versions recorded the time of the last index update here.
+	obsolete := l.config.AlexandriaDirectory + "index_updated"
+	if info, err := os.Stat(obsolete); err == nil {
+		garbage = append(garbage, garbageFile{obsolete, info.Size()})
+	}
+
+	return garbage, nil
+}
+
+// Find the intermediate files in a directory that have not been modified for
+// a while.
+func staleIntermediateFiles(dir string) ([]garbageFile, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "read temp directory")
+	}
+	var garbage []garbageFile
+	for _, file := range files {
+		if file.Mode().IsRegular() && hasExtension(file.Name(), intermediateExtensions) &&
+			time.Since(file.ModTime()) > staleAfter {
+			garbage = append(garbage, garbageFile{dir + file.Name(), file.Size()})
+		}
+	}
+	return garbage, nil
+}
+
+// List the work directories in the temp directory, see NewWorkDirectory.
+func (l *Library) workDirectories() ([]string, error) {
+	files, err := ioutil.ReadDir(l.config.TempDirectory)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "read temp directory")
+	}
+	var dirs []string
+	for _, file := range files {
+		if file.IsDir() && strings.HasPrefix(file.Name(), workDirectoryPrefix) {
+			dirs = append(dirs, l.config.TempDirectory+file.Name()+"/")
+		}
+	}
+	return dirs, nil
+}
+
+// Find the precompiled formats none of the backends needs any more, e.g.
+// because the header template has changed.  Formats built recently are kept,
+// as they may belong to a render using templates that have just changed.
+func (l *Library) unusedFormats() ([]garbageFile, error) {
+	inUse := make(map[string]bool)
+	for _, backend := range l.backends {
+		if user, ok := backend.(FormatUser); ok {
+			names, err := user.FormatsInUse()
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				inUse[name] = true
+			}
+		}
+	}
+
+	dir := l.FormatDirectory()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "read format directory")
+	}
+	var garbage []garbageFile
+	for _, file := range files {
+		if file.Mode().IsRegular() && filepath.Ext(file.Name()) == ".fmt" &&
+			!inUse[file.Name()] && time.Since(file.ModTime()) > staleAfter {
+			garbage = append(garbage, garbageFile{dir + file.Name(), file.Size()})
+		}
+	}
+	return garbage, nil
+}
+
+// Check whether a file in the cache directory is one the backends render
+// scrolls to, the cache key of such a file, or a recorded failure.  Other
+// files are left alone.
+func isRenderedFile(name string) bool {
+	return hasExtension(name, append(renderedExtensions, ".key", failureExtension))
+}
+
+// Check whether the name of a file ends in one of the given extensions.
+func hasExtension(name string, extensions []string) bool {
+	extension := filepath.Ext(name)
+	for _, e := range extensions {
+		if extension == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether a file in the cache directory belongs to one of the scrolls
+// that exist.
+func belongsToScroll(name string, exists map[ID]bool) bool {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	if exists[ID(base)] {
+		return true
+	}
+	groups := pageSuffixPattern.FindStringSubmatch(base)
+	return groups != nil && exists[ID(groups[1])]
+}
+
+// Compute the combined size of all the files CollectGarbage would delete.
+func (l *Library) reclaimableSize() (int64, error) {
+	garbage, err := l.findGarbage()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, file := range garbage {
+		size += file.size
+	}
+	return size, nil
+}
@@ -0,0 +1,69 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	config := NewConfiguration(t.TempDir())
+	for _, dir := range []string{config.KnowledgeDirectory, config.TempDirectory + "work-1/",
+		config.TempDirectory + "42/"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := NewLibrary(config)
+
+	old := time.Now().Add(-24 * time.Hour)
+	tests := []struct {
+		file    string
+		modTime time.Time
+		garbage bool
+	}{
+		{"3f2a.aux", old, true},
+		{"3f2a.log", old, true},
+		{"3f2a.pdf", old, true},
+		{"3f2b.pdf", time.Now(), false},
+		{"notes.txt", old, false},
+		{"work-1/s1.log", old, true},
+		{"work-1/s2.log", time.Now(), false},
+		{"42/s1.log", old, false},
+	}
+	for _, test := range tests {
+		path := config.TempDirectory + test.file
+		if err := ioutil.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, test.modTime, test.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := l.CollectGarbage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	numGarbage := 0
+	for _, test := range tests {
+		_, err := os.Stat(config.TempDirectory + test.file)
+		if test.garbage {
+			numGarbage++
+			if !os.IsNotExist(err) {
+				t.Errorf("%v was not removed", test.file)
+			}
+		} else if err != nil {
+			t.Errorf("%v was removed", test.file)
+		}
+	}
+	if report.NumFiles != numGarbage {
+		t.Errorf("removed %d files, expected %d", report.NumFiles, numGarbage)
+	}
+}
@@ -0,0 +1,361 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+	"github.com/pkg/errors"
+)
+
+// Library is a collection of scrolls together with its index and the files
+// the scrolls have been rendered to, all stored in the directories given by
+// its configuration.  It is safe for concurrent use: any number of searches
+// may run at the same time, while changes to the index are made one at a
+// time, with no searches running.
+type Library struct {
+	config Configuration
+	// The backends responsible for the scrolls stored in files with a
+	// given extension
+	backends map[string]Backend
+	// The other libraries searched together with this one, by name
+	members map[string]*Library
+
+	// Guards the fields below
+	mutex sync.Mutex
+	// The index kept open by Open, if any
+	index bleve.Index
+	// The socket the library is served on, see Serve
+	listener net.Listener
+
+	// Held for reading while searching the index, and for writing while
+	// changing it
+	indexMutex sync.RWMutex
+	// Held while the index is open without Open having been called
+	tempIndexMutex sync.Mutex
+}
+
+// NewLibrary creates a library with the given configuration.  Its backends
+// are created by the factories registered using RegisterBackend.  The
+// libraries in Config.Libraries are searched together with it, see
+// FindMatchingScrolls.
+func NewLibrary(config Configuration) *Library {
+	l := &Library{config: config, backends: make(map[string]Backend),
+		members: make(map[string]*Library)}
+	for extension, newBackend := range backendFactories {
+		l.backends[extension] = newBackend(l)
+	}
+	for name, dir := range config.Libraries {
+		if name == config.Name || strings.Contains(name, librarySeparator) {
+			LogError(errors.Errorf("invalid name for library %v: '%v'", dir, name))
+			continue
+		}
+		l.members[name] = NewLibrary(memberConfiguration(name, dir))
+	}
+	return l
+}
+
+// The library described by Config
+var (
+	defaultLibraryOnce sync.Once
+	defaultLibrary     *Library
+)
+
+// DefaultLibrary returns the library described by Config.  It is created when
+// it is first needed, so changes made to Config before that take effect.
+func DefaultLibrary() *Library {
+	defaultLibraryOnce.Do(func() {
+		defaultLibrary = NewLibrary(Config)
+	})
+	return defaultLibrary
+}
+
+// Config returns the configuration of the library.
+func (l *Library) Config() Configuration {
+	return l.config
+}
+
+// Members returns the other libraries searched together with this one, by
+// name.
+func (l *Library) Members() map[string]*Library {
+	return l.members
+}
+
+// libraryHandle gives access to the index of a library, either directly or
+// through another process serving the library.
+type libraryHandle interface {
+	UpdateIndex() (IndexUpdate, error)
+	UpdateScrolls(ids []ID) (IndexUpdate, error)
+	FindMatchingScrolls(query string) ([]ID, int, error)
+	ComputeStatistics() (Statistics, error)
+	RemoveFromIndex(id ID) error
+}
+
+// Open opens the index, creating it if necessary, and keeps it open until
+// Close is called.  Otherwise, the index is opened for every operation.  As
+// long as the library is open, no other process can open the index, so
+// long-running processes should make the library available to others using
+// Serve.  The other libraries searched together with this one are opened as
+// well, except for those another process is serving.
+func (l *Library) Open() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.index != nil {
+		return errors.New("the library is already open")
+	}
+
+	index, err := l.openOrCreateIndex()
+	if err != nil {
+		return errors.Wrap(err, "open or create index")
+	}
+	l.index = index
+
+	for name, member := range l.members {
+		if member.isServed() {
+			LogError(errors.Errorf("library %v is open in another process and cannot be searched", name))
+			continue
+		}
+		err = member.Open()
+		if err != nil {
+			return errors.Wrapf(err, "open library %v", name)
+		}
+	}
+	return nil
+}
+
+// Close stops serving the library and closes the index opened by Open, as
+// well as the other libraries opened with it.
+func (l *Library) Close() error {
+	for _, member := range l.members {
+		TryLogError(member.Close())
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.listener != nil {
+		TryLogError(l.listener.Close())
+		l.listener = nil
+	}
+	if l.index == nil {
+		return nil
+	}
+
+	// Wait for the operations using the index to finish.
+	l.indexMutex.Lock()
+	defer l.indexMutex.Unlock()
+	err := l.index.Close()
+	l.index = nil
+	return errors.Wrap(err, "close index")
+}
+
+// Get the index kept open by Open, if any.
+func (l *Library) openIndex() bleve.Index {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.index
+}
+
+// Run f on the index kept open by Open, if any, or else on the library
+// served by another process.  Only if there is neither is the index opened
+// just for f, which fails if another process has the index open.  The same
+// goes for the indexes of the other libraries searched together with this
+// one, except that those served by another process are left out.
+func (l *Library) withIndex(f func(libraryHandle) error) error {
+	if index := l.openIndex(); index != nil {
+		members := make(map[string]bleve.Index)
+		for name, member := range l.members {
+			if memberIndex := member.openIndex(); memberIndex != nil {
+				members[name] = memberIndex
+			}
+		}
+		return f(localIndex{l, index, members})
+	}
+
+	client, err := l.dial()
+	if err == nil {
+		defer client.Close()
+		return f(client)
+	}
+
+	// Opening the index twice in the same process would block.
+	l.tempIndexMutex.Lock()
+	defer l.tempIndexMutex.Unlock()
+	index, err := l.openOrCreateIndex()
+	if err != nil {
+		return errors.Wrap(err, "open or create index")
+	}
+	defer index.Close()
+
+	members := make(map[string]bleve.Index)
+	for name, member := range l.members {
+		if member.isServed() {
+			LogError(errors.Errorf("library %v is open in another process and cannot be searched", name))
+			continue
+		}
+		member.tempIndexMutex.Lock()
+		defer member.tempIndexMutex.Unlock()
+		memberIndex, err := member.openOrCreateIndex()
+		if err != nil {
+			return errors.Wrapf(err, "open or create index of library %v", name)
+		}
+		defer memberIndex.Close()
+		members[name] = memberIndex
+	}
+	return f(localIndex{l, index, members})
+}
+
+// UpdateIndex brings the index up to date with the library.  If
+// Config.CollectGarbage is set, the files no longer needed are deleted
+// afterwards.
+func (l *Library) UpdateIndex() (update IndexUpdate, err error) {
+	err = l.withIndex(func(h libraryHandle) error {
+		update, err = h.UpdateIndex()
+		return err
+	})
+	return update, err
+}
+
+// UpdateScrolls brings the index up to date with the scrolls with the given
+// IDs only, which is much faster than UpdateIndex if only a few scrolls have
+// changed.  Scrolls that no longer exist are removed from the index.
+func (l *Library) UpdateScrolls(ids []ID) (update IndexUpdate, err error) {
+	err = l.withIndex(func(h libraryHandle) error {
+		update, err = h.UpdateScrolls(ids)
+		return err
+	})
+	return update, err
+}
+
+// FindMatchingScrolls asks the index for all scrolls matching the given
+// query.  It returns the IDs of the first of those scrolls, the total number
+// of matches (which can be much greater than the number of IDs returned), and
+// an error, if any occurred.
+//
+// The other libraries searched together with this one are searched as well.
+// The IDs of their scrolls are prefixed with the name of the library and a
+// slash, e.g. "shared/foo".  The query may be restricted to some of the
+// libraries using terms like library:shared, or exclude some of them using
+// terms like -library:shared.
+func (l *Library) FindMatchingScrolls(query string) (ids []ID, totalMatches int, err error) {
+	err = l.withIndex(func(h libraryHandle) error {
+		ids, totalMatches, err = h.FindMatchingScrolls(query)
+		return err
+	})
+	return ids, totalMatches, err
+}
+
+// ComputeStatistics counts the scrolls in the library and computes their
+// combined size, as well as the size of the files CollectGarbage would
+// delete.
+func (l *Library) ComputeStatistics() (statistics Statistics, err error) {
+	err = l.withIndex(func(h libraryHandle) error {
+		statistics, err = h.ComputeStatistics()
+		return err
+	})
+	return statistics, err
+}
+
+// RemoveFromIndex removes a specified document from the index.  This allows
+// the renderers to drop scrolls deleted since the last call to UpdateIndex.
+func (l *Library) RemoveFromIndex(id ID) error {
+	return l.withIndex(func(h libraryHandle) error {
+		return h.RemoveFromIndex(id)
+	})
+}
+
+// LoadScrolls reads and parses the scrolls with the given IDs, which may
+// belong to any of the libraries searched together with this one.
+func (l *Library) LoadScrolls(ids []ID) ([]Scroll, error) {
+	result := make([]Scroll, len(ids))
+	for i, id := range ids {
+		library, localID := l.resolveID(id)
+		scroll, err := library.loadAndParseScrollContentByID(localID)
+		if err != nil {
+			return result, err
+		}
+		scroll.ID = id
+		scroll.Library = library.config.Name
+		result[i] = scroll
+	}
+	return result, nil
+}
+
+// localIndex accesses the index of a library opened by this process, along
+// with the indexes of the other libraries searched together with it.
+type localIndex struct {
+	library *Library
+	index   bleve.Index
+	members map[string]bleve.Index
+}
+
+func (i localIndex) UpdateIndex() (IndexUpdate, error) {
+	i.library.indexMutex.Lock()
+	update, err := i.library.updateIndex(i.index)
+	i.library.indexMutex.Unlock()
+	if err != nil {
+		return update, err
+	}
+	if i.library.config.CollectGarbage {
+		update.Garbage, err = i.library.CollectGarbage()
+		if err != nil {
+			return update, errors.Wrap(err, "collect garbage")
+		}
+	}
+
+	for name, index := range i.members {
+		member := i.library.members[name]
+		memberUpdate, err := localIndex{member, index, nil}.UpdateIndex()
+		if err != nil {
+			return update, errors.Wrapf(err, "update library %v", name)
+		}
+		update.add(name, memberUpdate)
+	}
+	return update, nil
+}
+
+func (i localIndex) UpdateScrolls(ids []ID) (IndexUpdate, error) {
+	i.library.indexMutex.Lock()
+	defer i.library.indexMutex.Unlock()
+	return i.library.updateScrolls(i.index, ids)
+}
+
+func (i localIndex) FindMatchingScrolls(query string) ([]ID, int, error) {
+	query, libraries, err := i.library.selectLibraries(query)
+	if err != nil {
+		return []ID{}, 0, err
+	}
+
+	var indexes []bleve.Index
+	for _, library := range libraries {
+		index := i.index
+		if library != i.library {
+			var ok bool
+			index, ok = i.members[library.config.Name]
+			if !ok {
+				continue
+			}
+		}
+		library.indexMutex.RLock()
+		defer library.indexMutex.RUnlock()
+		indexes = append(indexes, index)
+	}
+	return i.library.findMatchingScrolls(bleve.NewIndexAlias(indexes...), query)
+}
+
+func (i localIndex) ComputeStatistics() (Statistics, error) {
+	i.library.indexMutex.RLock()
+	defer i.library.indexMutex.RUnlock()
+	return i.library.computeStatistics(i.index)
+}
+
+func (i localIndex) RemoveFromIndex(id ID) error {
+	i.library.indexMutex.Lock()
+	defer i.library.indexMutex.Unlock()
+	return errors.Wrapf(i.index.Delete(string(id)), "remove %v from index", id)
+}
@@ -0,0 +1,94 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// parserVersion has to be incremented whenever the way scrolls are parsed or
+// indexed changes, so that all scrolls get reindexed.
+const parserVersion = 2
+
+// manifest records the content hashes of all the scrolls in the index, so
+// UpdateIndex knows exactly which scrolls have to be reindexed.
+type manifest struct {
+	// Version identifies the parsing logic used to build the index
+	Version string `json:"version"`
+	// Scrolls maps the IDs of all indexed scrolls to their content hashes
+	Scrolls map[ID]string `json:"scrolls"`
+}
+
+func (l *Library) manifestFile() string {
+	return l.config.AlexandriaDirectory + "manifest.json"
+}
+
+// Compute the version of the parsing logic.  This changes whenever
+// parserVersion is incremented, a backend is registered for a different set
+// of file extensions, or Config.TypeAliases changes, as the aliases are
+// expanded when parsing a scroll.
+func (l *Library) currentManifestVersion() string {
+	var aliases []string
+	for alias, scrollType := range l.config.TypeAliases {
+		aliases = append(aliases, alias+"="+scrollType)
+	}
+	sort.Strings(aliases)
+	data := strconv.Itoa(parserVersion) + ":" + strings.Join(l.registeredExtensions(), ",") +
+		":" + strings.Join(aliases, ",")
+	return hashString(data)
+}
+
+func hashString(data string) string {
+	hash := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(hash[:])
+}
+
+// Load the manifest from disk.  If there is no manifest yet, or if it was
+// written by a different version of the parsing logic, an empty manifest is
+// returned, causing all scrolls to be reindexed.
+func (l *Library) loadManifest() (manifest, error) {
+	empty := manifest{Version: l.currentManifestVersion(), Scrolls: make(map[ID]string)}
+
+	data, err := ioutil.ReadFile(l.manifestFile())
+	if os.IsNotExist(err) {
+		return empty, nil
+	} else if err != nil {
+		return empty, errors.Wrap(err, "read manifest")
+	}
+
+	var m manifest
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return empty, errors.Wrap(err, "parse manifest")
+	}
+	if m.Version != empty.Version || m.Scrolls == nil {
+		return empty, nil
+	}
+	return m, nil
+}
+
+// Write the manifest to disk, replacing the previous one atomically.
+func (l *Library) saveManifest(m manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "encode manifest")
+	}
+	tmpFile := l.manifestFile() + ".tmp"
+	err = ioutil.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return errors.Wrap(err, "write manifest")
+	}
+	return errors.Wrap(os.Rename(tmpFile, l.manifestFile()), "replace manifest")
+}
@@ -0,0 +1,55 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Display maths ($$...$$, \[...\] and environments like align) as well as
+// inline maths ($...$ and \(...\)).
+var mathPattern = regexp.MustCompile(`(?s)\$\$.+?\$\$|\\\[.+?\\\]|\\\(.+?\\\)|\$[^$\n]+?\$|` +
+	`\\begin\{(?:equation|align|alignat|gather|multline|eqnarray|displaymath)\*?\}.+?` +
+	`\\end\{(?:equation|align|alignat|gather|multline|eqnarray|displaymath)\*?\}`)
+
+func mathPlaceholder(i int) string {
+	return "ALEXANDRIAMATH" + strconv.Itoa(i) + "X"
+}
+
+// ProtectMath replaces all mathematics in a document by placeholders, so that
+// converting the rest of the document to HTML does not mangle it, e.g. by
+// mistaking `a_1 * b_2` for emphasis.  The original formulae are returned so
+// they can be put back using RestoreMath.
+func ProtectMath(doc string) (string, []string) {
+	var result strings.Builder
+	var formulae []string
+	last := 0
+	for _, match := range mathPattern.FindAllStringIndex(doc, -1) {
+		start, end := match[0], match[1]
+		if start < last || (start > 0 && doc[start-1] == '\\') {
+			// An escaped dollar sign is no maths delimiter.
+			continue
+		}
+		result.WriteString(doc[last:start])
+		result.WriteString(mathPlaceholder(len(formulae)))
+		formulae = append(formulae, doc[start:end])
+		last = end
+	}
+	result.WriteString(doc[last:])
+	return result.String(), formulae
+}
+
+// RestoreMath puts the formulae back in place of the placeholders, leaving the
+// delimiters intact for KaTeX or MathJax to pick up in the browser.
+func RestoreMath(doc string, formulae []string) string {
+	for i := len(formulae) - 1; i >= 0; i-- {
+		doc = strings.Replace(doc, mathPlaceholder(i), html.EscapeString(formulae[i]), 1)
+	}
+	return doc
+}
@@ -0,0 +1,81 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"strings"
+)
+
+// ParseTags parses a comma separated list of tags into a slice.
+func ParseTags(line string) []string {
+	var tags []string
+	for _, tag := range strings.Split(line, ",") {
+		tmp := strings.TrimSpace(tag)
+		if tmp != "" {
+			tags = append(tags, tmp)
+		}
+	}
+	return tags
+}
+
+// Replace an abbreviated scroll type like "lem" by the full name, e.g.
+// "lemma", according to Config.TypeAliases.
+func (l *Library) resolveTypeAlias(scrollType string) string {
+	if fullName, ok := l.config.TypeAliases[strings.ToLower(scrollType)]; ok {
+		return fullName
+	}
+	return scrollType
+}
+
+// ParseMetadata creates a scroll from its content and its metadata lines.
+// The metadata lines have the same meaning regardless of the format the
+// scroll is written in:
+//
+//	@source Author: Title
+//	@source Lemma 3.2, p. 41
+//	@type proposition, definition
+//	@hidden some, tags, not shown to the user
+//	counter-example, analysis, TopOloGY, Weierstraß
+//
+// Lines starting with any other @-keyword are kept verbatim, all other lines
+// are interpreted as comma separated lists of tags.  Abbreviated types are
+// expanded using Config.TypeAliases.
+func (l *Library) ParseMetadata(id ID, content string, metadata []string) Scroll {
+	var source []string
+	var hidden []string
+	var scrollType string
+	var tags []string
+	var otherLines []string
+
+	for _, line := range metadata {
+		switch {
+		case strings.HasPrefix(line, "@hidden "):
+			hidden = append(hidden, ParseTags(strings.TrimPrefix(line, "@hidden "))...)
+		case strings.HasPrefix(line, "@source "):
+			source = append(source, strings.TrimSpace(strings.TrimPrefix(line, "@source ")))
+		case strings.HasPrefix(line, "@type "):
+			tmp := strings.TrimSpace(strings.TrimPrefix(line, "@type "))
+			for _, typ := range strings.Split(tmp, ",") {
+				// Ignore all but the first type, the other
+				// ones are just for searching
+				if scrollType == "" {
+					scrollType = l.resolveTypeAlias(strings.TrimSpace(typ))
+					break
+				}
+			}
+		case strings.HasPrefix(line, "@"):
+			// Do not strip the @[a-zA-Z0-9\-]** prefix, otherwise
+			// there is no way to tell what the line signifies.
+			otherLines = append(otherLines, line)
+		default:
+			tags = append(tags, ParseTags(line)...)
+		}
+	}
+
+	return Scroll{ID: id, Content: content, Type: scrollType,
+		SourceLines: source, Tags: tags, Hidden: hidden,
+		OtherLines: otherLines}
+}
@@ -0,0 +1,222 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// BackendFactory creates the backend responsible for some kind of scroll in
+// the given library.
+type BackendFactory func(l *Library) Backend
+
+// backendFactories maps file extensions, including the leading dot, to the
+// factories creating the backends responsible for scrolls stored in files
+// with that extension.
+var backendFactories = make(map[string]BackendFactory)
+
+// RegisterBackend makes the backends created by the given factory responsible
+// for all scrolls stored in files with the given extension, e.g. ".tex", in
+// the libraries created afterwards.  Registering a second factory for the same
+// extension replaces the first one.
+func RegisterBackend(extension string, newBackend BackendFactory) {
+	backendFactories[extension] = newBackend
+}
+
+// Get all the file extensions the library has backends for in a well-defined
+// order.
+func (l *Library) registeredExtensions() []string {
+	var extensions []string
+	for extension := range l.backends {
+		extensions = append(extensions, extension)
+	}
+	sort.Strings(extensions)
+	return extensions
+}
+
+// Determine the ID of the scroll stored in a file with the given name as
+// well as its extension.  If no backend is registered for that kind of file,
+// ok is false.
+func (l *Library) splitScrollFileName(fileName string) (id ID, extension string, ok bool) {
+	for _, extension := range l.registeredExtensions() {
+		if strings.HasSuffix(fileName, extension) {
+			return ID(strings.TrimSuffix(fileName, extension)), extension, true
+		}
+	}
+	return "", "", false
+}
+
+// Find the extension of the file containing the scroll with the given ID.
+func (l *Library) findScrollFile(id ID) (string, error) {
+	for _, extension := range l.registeredExtensions() {
+		_, err := os.Stat(l.config.KnowledgeDirectory + string(id) + extension)
+		if err == nil {
+			return extension, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", errors.Wrapf(err, "stat scroll %v", id)
+		}
+	}
+	return "", errors.Wrapf(&os.PathError{Op: "find", Path: l.config.KnowledgeDirectory + string(id) + ".*", Err: os.ErrNotExist},
+		"find scroll %v", id)
+}
+
+// BackendForScroll returns the backend responsible for the scroll with the
+// given ID.
+func (l *Library) BackendForScroll(id ID) (Backend, error) {
+	extension, err := l.findScrollFile(id)
+	if err != nil {
+		return nil, err
+	}
+	return l.backends[extension], nil
+}
+
+// allScrollIDs lists the IDs of all scrolls in the library that are stored in
+// a format some backend is registered for.
+func (l *Library) allScrollIDs() ([]ID, error) {
+	return l.ScrollIDs("")
+}
+
+// ScrollIDs lists the IDs of the scrolls in the library stored in files with
+// the given extension, e.g. ".tex", i.e. the scrolls the backend registered
+// for that extension is responsible for.  If the extension is empty, all
+// scrolls are listed.
+func (l *Library) ScrollIDs(extension string) ([]ID, error) {
+	files, err := ioutil.ReadDir(l.config.KnowledgeDirectory)
+	if err != nil {
+		return nil, errors.Wrap(err, "read knowledge directory")
+	}
+
+	var ids []ID
+	for _, file := range files {
+		id, e, ok := l.splitScrollFileName(file.Name())
+		if ok && (extension == "" || e == extension) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// A library is a backend itself, passing each scroll on to the backend for the
+// extension of the file the scroll is stored in.
+
+// RenderAllScrolls lets every backend of the library render all the scrolls
+// it is responsible for, so that backends can render them more efficiently
+// than one by one.  The same is done for the libraries searched together with
+// this one.
+func (l *Library) RenderAllScrolls(ctx context.Context) (numScrolls int, errors []error) {
+	for _, extension := range l.registeredExtensions() {
+		n, errs := l.backends[extension].RenderAllScrolls(ctx)
+		numScrolls += n
+		errors = append(errors, errs...)
+	}
+	for name, member := range l.members {
+		n, errs := member.RenderAllScrolls(ctx)
+		qualifyErrors(name, errs)
+		numScrolls += n
+		errors = append(errors, errs...)
+	}
+	return numScrolls, errors
+}
+
+// RenderScrollsByID lets the backends of the library render the given
+// scrolls, returning the IDs of the scrolls rendered in the order given.  The
+// scrolls may belong to any of the libraries searched together with this one.
+func (l *Library) RenderScrollsByID(ctx context.Context, ids []ID) (renderedScrollIDs []ID, errs []error) {
+	var ownIDs []ID
+	idsByMember := make(map[string][]ID)
+	for _, id := range ids {
+		library, localID := l.resolveID(id)
+		if library == l {
+			ownIDs = append(ownIDs, id)
+		} else {
+			name := library.config.Name
+			idsByMember[name] = append(idsByMember[name], localID)
+		}
+	}
+	if len(idsByMember) == 0 {
+		return l.renderScrollsByID(ctx, ids)
+	}
+
+	rendered := make(map[ID]bool)
+	renderedIDs, errs := l.renderScrollsByID(ctx, ownIDs)
+	for _, id := range renderedIDs {
+		rendered[id] = true
+	}
+	for name, memberIDs := range idsByMember {
+		renderedIDs, memberErrs := l.members[name].renderScrollsByID(ctx, memberIDs)
+		for _, id := range renderedIDs {
+			rendered[qualifiedID(name, id)] = true
+		}
+		qualifyErrors(name, memberErrs)
+		errs = append(errs, memberErrs...)
+	}
+
+	for _, id := range ids {
+		if rendered[id] {
+			renderedScrollIDs = append(renderedScrollIDs, id)
+		}
+	}
+	return renderedScrollIDs, errs
+}
+
+// Render the given scrolls, all of which belong to this library, see
+// RenderScrollsByID.
+func (l *Library) renderScrollsByID(ctx context.Context, ids []ID) (renderedScrollIDs []ID, errs []error) {
+	var extensions []string
+	idsByExtension := make(map[string][]ID)
+	for _, id := range ids {
+		extension, err := l.findScrollFile(id)
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				// The scroll has been deleted since the index
+				// was last updated.
+				TryLogError(l.RemoveFromIndex(id))
+			}
+			LogError(err)
+			errs = append(errs, &RenderError{ID: id, Stage: StageTemplate, Err: err})
+			continue
+		}
+		if _, ok := idsByExtension[extension]; !ok {
+			extensions = append(extensions, extension)
+		}
+		idsByExtension[extension] = append(idsByExtension[extension], id)
+	}
+
+	rendered := make(map[ID]bool)
+	for _, extension := range extensions {
+		renderedIDs, errors := l.backends[extension].RenderScrollsByID(ctx, idsByExtension[extension])
+		for _, id := range renderedIDs {
+			rendered[id] = true
+		}
+		errs = append(errs, errors...)
+	}
+
+	// Preserve the order of the IDs we were given, as it reflects the
+	// relevance of the scrolls to the query.
+	for _, id := range ids {
+		if rendered[id] {
+			renderedScrollIDs = append(renderedScrollIDs, id)
+		}
+	}
+	return renderedScrollIDs, errs
+}
+
+// Parse parses the scroll using the backend for the file it is stored in.
+func (l *Library) Parse(id, doc string) Scroll {
+	b, err := l.BackendForScroll(ID(id))
+	if err != nil {
+		LogError(err)
+		return Scroll{ID: ID(id), Content: doc}
+	}
+	return b.Parse(id, doc)
+}
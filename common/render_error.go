@@ -0,0 +1,104 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"errors"
+	"fmt"
+)
+
+// RenderStage identifies the step of the rendering pipeline that failed.
+type RenderStage string
+
+const (
+	// StageTemplate is the assembly of the LaTeX file from the scroll
+	// and the templates.
+	StageTemplate RenderStage = "template"
+	// StageLatex is the compilation of the LaTeX file.
+	StageLatex RenderStage = "latex"
+	// StageConvert is the conversion of the resulting PDF to an image,
+	// or of the scroll to HTML.
+	StageConvert RenderStage = "convert"
+)
+
+// RenderError describes why a scroll could not be rendered.
+type RenderError struct {
+	ID    ID
+	Stage RenderStage
+	// Line is the line of the scroll causing the error, or 0 if the
+	// error cannot be attributed to any line of the scroll, e.g. because
+	// it occurred in one of the templates.
+	Line int
+	// Message is the error message reported by TeX, i.e. the line
+	// starting with "!", without the exclamation mark.
+	Message string
+	// Err is the underlying error, including e.g. the output of TeX.
+	Err error
+}
+
+func (e *RenderError) Error() string {
+	result := fmt.Sprintf("rendering %v failed at the %v stage", e.ID, e.Stage)
+	if e.Line > 0 {
+		result += fmt.Sprintf(" in line %d", e.Line)
+	}
+	if e.Message != "" {
+		return result + ": " + e.Message
+	}
+	if e.Err != nil {
+		return result + ": " + e.Err.Error()
+	}
+	return result
+}
+
+// Format prints the underlying error, including e.g. the full TeX output, in
+// addition to the error message when formatted using %+v.
+func (e *RenderError) Format(s fmt.State, verb rune) {
+	fmt.Fprint(s, e.Error())
+	if verb == 'v' && s.Flag('+') && e.Err != nil {
+		fmt.Fprintf(s, "\n%+v", e.Err)
+	}
+}
+
+// Cause returns the underlying error, so errors.Cause can find it.
+func (e *RenderError) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns the underlying error, so errors.Is and errors.As can find it.
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+// ErrRenderTimeout is the cause of the RenderError reported for a scroll that
+// took longer than Config.RenderTimeout to render, e.g. because of an infinite
+// loop in TeX.
+var ErrRenderTimeout = errors.New("rendering timed out")
+
+// IsRenderTimeout checks whether an error returned by a backend was caused by
+// a scroll taking too long to render.
+func IsRenderTimeout(err error) bool {
+	return errors.Is(err, ErrRenderTimeout)
+}
+
+// RenderWarning describes a problem that did not prevent a scroll from being
+// rendered, e.g. an unknown type causing the fallback template to be used.
+// Backends report warnings alongside errors, but still count the scroll as
+// rendered.
+type RenderWarning struct {
+	ID      ID
+	Message string
+}
+
+func (w *RenderWarning) Error() string {
+	return fmt.Sprintf("rendering %v: warning: %v", w.ID, w.Message)
+}
+
+// IsRenderWarning checks whether an error returned by a backend is merely a
+// warning.
+func IsRenderWarning(err error) bool {
+	var warning *RenderWarning
+	return errors.As(err, &warning)
+}
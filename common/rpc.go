@@ -0,0 +1,208 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// The directory containing the socket.  Only its owner may access it, so that
+// no other user can connect to the socket, not even while it is being created
+// with the default permissions.
+func (l *Library) socketDirectory() string {
+	return l.config.AlexandriaDirectory + "run/"
+}
+
+// The Unix domain socket a running server makes the library available on
+func (l *Library) socketFile() string {
+	return l.socketDirectory() + "alexandria.sock"
+}
+
+// Serve makes the library available to other processes of the same user, in
+// particular the command line interface, through a Unix domain socket in a
+// private subdirectory of the Alexandria directory.  This way they can search
+// and update the index while this process keeps it open.  Serve returns when
+// the library is closed.
+func (l *Library) Serve() error {
+	path := l.socketFile()
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return errors.New("another process is already serving the library")
+	}
+	err := os.MkdirAll(l.socketDirectory(), 0700)
+	if err == nil {
+		// The directory may have been created with other permissions.
+		err = os.Chmod(l.socketDirectory(), 0700)
+	}
+	if err != nil {
+		return errors.Wrap(err, "create socket directory")
+	}
+	// Remove the socket of a process that did not exit cleanly.
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove stale socket")
+	}
+
+	server := rpc.NewServer()
+	err = server.RegisterName("Library", libraryService{l})
+	if err != nil {
+		return errors.Wrap(err, "register library service")
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return errors.Wrap(err, "listen on socket")
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return errors.Wrap(err, "restrict access to socket")
+	}
+
+	l.mutex.Lock()
+	l.listener = listener
+	l.mutex.Unlock()
+
+	// Serve the libraries opened together with this one, too, as no other
+	// process can open them either.
+	for name, member := range l.members {
+		if member.openIndex() == nil {
+			continue
+		}
+		go func(name string, member *Library) {
+			err := member.Serve()
+			if err != nil {
+				LogError(errors.Wrapf(err, "serve library %v", name))
+			}
+		}(name, member)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			l.mutex.Lock()
+			closed := l.listener != listener
+			l.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return errors.Wrap(err, "accept connection")
+		}
+		go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
+
+// SearchResults is what a served library sends in reply to a search.
+type SearchResults struct {
+	IDs          []ID
+	TotalMatches int
+}
+
+// StatisticsReply is what a served library sends in reply to a request for
+// its statistics.
+type StatisticsReply struct {
+	NumScrolls      int
+	TotalSize       int64
+	ReclaimableSize int64
+}
+
+// libraryService exposes the methods of a library via RPC.
+type libraryService struct {
+	library *Library
+}
+
+func (s libraryService) UpdateIndex(args struct{}, reply *IndexUpdate) (err error) {
+	*reply, err = s.library.UpdateIndex()
+	return err
+}
+
+func (s libraryService) UpdateScrolls(ids []ID, reply *IndexUpdate) (err error) {
+	*reply, err = s.library.UpdateScrolls(ids)
+	return err
+}
+
+func (s libraryService) FindMatchingScrolls(query string, reply *SearchResults) (err error) {
+	reply.IDs, reply.TotalMatches, err = s.library.FindMatchingScrolls(query)
+	return err
+}
+
+func (s libraryService) ComputeStatistics(args struct{}, reply *StatisticsReply) error {
+	statistics, err := s.library.ComputeStatistics()
+	if err != nil {
+		return err
+	}
+	*reply = StatisticsReply{statistics.NumberOfScrolls(), statistics.TotalSize(),
+		statistics.ReclaimableSize()}
+	return nil
+}
+
+func (s libraryService) RemoveFromIndex(id ID, reply *struct{}) error {
+	return s.library.RemoveFromIndex(id)
+}
+
+// libraryClient accesses a library served by another process.
+type libraryClient struct {
+	client *rpc.Client
+}
+
+// Connect to the process serving the library, if there is one.
+func (l *Library) dial() (*libraryClient, error) {
+	conn, err := net.Dial("unix", l.socketFile())
+	if err != nil {
+		return nil, err
+	}
+	return &libraryClient{jsonrpc.NewClient(conn)}, nil
+}
+
+// Check whether another process is serving the library.
+func (l *Library) isServed() bool {
+	client, err := l.dial()
+	if err != nil {
+		return false
+	}
+	client.Close()
+	return true
+}
+
+func (c *libraryClient) Close() error {
+	return c.client.Close()
+}
+
+func (c *libraryClient) UpdateIndex() (IndexUpdate, error) {
+	var update IndexUpdate
+	err := c.client.Call("Library.UpdateIndex", struct{}{}, &update)
+	return update, errors.Wrap(err, "update served index")
+}
+
+func (c *libraryClient) UpdateScrolls(ids []ID) (IndexUpdate, error) {
+	var update IndexUpdate
+	err := c.client.Call("Library.UpdateScrolls", ids, &update)
+	return update, errors.Wrap(err, "update served index")
+}
+
+func (c *libraryClient) FindMatchingScrolls(query string) ([]ID, int, error) {
+	var results SearchResults
+	err := c.client.Call("Library.FindMatchingScrolls", query, &results)
+	return results.IDs, results.TotalMatches, errors.Wrap(err, "search served index")
+}
+
+func (c *libraryClient) ComputeStatistics() (Statistics, error) {
+	var reply StatisticsReply
+	err := c.client.Call("Library.ComputeStatistics", struct{}{}, &reply)
+	if err != nil {
+		return stats{}, errors.Wrap(err, "compute statistics of served library")
+	}
+	return stats{reply.NumScrolls, reply.TotalSize, reply.ReclaimableSize}, nil
+}
+
+func (c *libraryClient) RemoveFromIndex(id ID) error {
+	err := c.client.Call("Library.RemoveFromIndex", id, &struct{}{})
+	return errors.Wrapf(err, "remove %v from served index", id)
+}
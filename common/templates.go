@@ -0,0 +1,109 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The directory containing the user's own TeX templates, which take
+// precedence over the ones built into Alexandria.
+func (l *Library) texTemplateDirectory() string {
+	return l.config.TemplateDirectory + "tex/"
+}
+
+// Load the content of a template file with the given name.  Templates in the
+// user's template directory override the built-in ones.
+func (l *Library) ReadTemplate(filename string) (string, error) {
+	result, err := ioutil.ReadFile(l.texTemplateDirectory() + filename + ".tex")
+	if err == nil {
+		return string(result), nil
+	} else if !os.IsNotExist(err) {
+		return "", errors.Wrapf(err, "read template %v", filename)
+	}
+
+	path := "tex/" + filename + ".tex"
+	file, err := Assets.Open(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "opening asset %v", path)
+	}
+	defer file.Close()
+	result, err = ioutil.ReadAll(file)
+	return string(result), errors.Wrap(err, "readall")
+}
+
+// List the names of the TeX templates in the user's template directory.
+func (l *Library) userTexTemplateFiles() []string {
+	files, err := ioutil.ReadDir(l.texTemplateDirectory())
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".tex") {
+			names = append(names, file.Name())
+		}
+	}
+	return names
+}
+
+// List the names of the built-in TeX templates.
+func assetTexTemplateFiles() []string {
+	dir, err := Assets.Open("tex")
+	if err != nil {
+		LogError(err)
+		return nil
+	}
+	defer dir.Close()
+	files, err := dir.Readdir(0)
+	if err != nil {
+		LogError(err)
+		return nil
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".tex") {
+			names = append(names, file.Name())
+		}
+	}
+	return names
+}
+
+// TemplateTypes lists all scroll types for which there is a template, either
+// in the user's template directory or built into Alexandria.  A type is
+// defined by a template file called <type>_header.tex.
+func (l *Library) TemplateTypes() []string {
+	seen := make(map[string]bool)
+	var types []string
+	for _, name := range append(l.userTexTemplateFiles(), assetTexTemplateFiles()...) {
+		if !strings.HasSuffix(name, "_header.tex") {
+			continue
+		}
+		scrollType := strings.TrimSuffix(name, "_header.tex")
+		if !seen[scrollType] {
+			seen[scrollType] = true
+			types = append(types, scrollType)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// KnownTypes returns the set of TemplateTypes.  Listing them means reading
+// the template directories, so this is done once for all the scrolls rendered
+// or checked together rather than for every single one.
+func (l *Library) KnownTypes() map[string]bool {
+	knownTypes := make(map[string]bool)
+	for _, t := range l.TemplateTypes() {
+		knownTypes[t] = true
+	}
+	return knownTypes
+}
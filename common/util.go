@@ -3,6 +3,7 @@
 // See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
 // license details.
 
+//go:generate sh ../contrib/fetch_mathjax.sh
 //go:generate go run ../contrib/generate_assets.go
 
 package common
@@ -11,6 +12,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
 
 	"github.com/pkg/errors"
 )
@@ -27,27 +29,50 @@ func TryLogError(err interface{}) {
 	}
 }
 
-// Load the content of a given scroll from disk.
-func ReadScroll(id ID) (string, error) {
-	result, err := ioutil.ReadFile(Config.KnowledgeDirectory + string(id) + ".tex")
+// Load the content of a given scroll from disk, whatever its format.
+func (l *Library) ReadScroll(id ID) (string, error) {
+	extension, err := l.findScrollFile(id)
+	if err != nil {
+		return "", err
+	}
+	return l.readScrollFile(id, extension)
+}
+
+// Load the content of a scroll stored in a file with the given extension.
+func (l *Library) readScrollFile(id ID, extension string) (string, error) {
+	result, err := ioutil.ReadFile(l.config.KnowledgeDirectory + string(id) + extension)
 	return string(result), errors.Wrapf(err, "read scroll %v", id)
 }
 
-// Load the content of a template file with the given name.
-func ReadTemplate(filename string) (string, error) {
-	path := "tex/" + filename + ".tex"
-	file, err := Assets.Open(path)
+// The prefix of the names of the directories created by NewWorkDirectory
+const workDirectoryPrefix = "work-"
+
+// NewWorkDirectory creates a directory in the temp directory for a renderer
+// to keep its intermediate files in.  Every render gets a directory of its
+// own, so that renders running at the same time, possibly in different
+// processes, do not overwrite each other's files.
+func (l *Library) NewWorkDirectory() (string, error) {
+	err := os.MkdirAll(l.config.TempDirectory, 0755)
+	if err != nil {
+		return "", errors.Wrap(err, "create temp directory")
+	}
+	dir, err := ioutil.TempDir(l.config.TempDirectory, workDirectoryPrefix)
 	if err != nil {
-		return "", errors.Wrapf(err, "opening asset %v", path)
+		return "", errors.Wrap(err, "create work directory")
 	}
-	result, err := ioutil.ReadAll(file)
-	return string(result), errors.Wrap(err, "readall")
+	return dir + "/", nil
 }
 
-// Write a TeX file with the given name and content to Alexandria's temp
+// FormatDirectory returns the directory in the temp directory where the
+// precompiled formats shared by all renders are kept.
+func (l *Library) FormatDirectory() string {
+	return l.config.TempDirectory + "formats/"
+}
+
+// Write a TeX file with the given name and content to the given temp
 // directory.
-func WriteTemp(id ID, data string) error {
-	err := ioutil.WriteFile(Config.TempDirectory+string(id)+".tex", []byte(data), 0644)
+func WriteTemp(dir string, id ID, data string) error {
+	err := ioutil.WriteFile(dir+string(id)+".tex", []byte(data), 0644)
 	return errors.Wrapf(err, "write %v.tex to temporary directory", id)
 }
 
@@ -67,71 +92,94 @@ func getDirSize(dir string) (int, int64, error) {
 	return len(fileInfo), result, nil
 }
 
-// Get the time a given file was last modified as a Unix time.
-func getModTime(file string) (int64, error) {
-	info, err := os.Stat(file)
-	if err != nil {
-		return -1, errors.Wrapf(err, "stat %v", file)
+// The extensions of the files the backends render scrolls to
+var renderedExtensions = []string{".png", ".svg", ".html"}
+
+// The extension of the files LaTeX scrolls are supposed to be rendered to
+func (l *Library) preferredExtension() string {
+	if l.config.RenderLatexToHTML {
+		return ".html"
 	}
-	return info.ModTime().Unix(), nil
-}
-
-// Cache the newest modification of any of the template files as a Unix time
-// (i.e. seconds since 1970-01-01).
-var templatesModTime int64 = -1
-
-// All recognized template files
-// TODO Generate the list⁈
-var templateFiles = []string{
-	"header.tex", "footer.tex",
-	"algorithm_header.tex", "algorithm_footer.tex",
-	"axiom_header.tex", "axiom_footer.tex",
-	"corollary_header.tex", "corollary_footer.tex",
-	"definition_header.tex", "definition_footer.tex",
-	"example_header.tex", "example_footer.tex",
-	"exercise_header.tex", "exercise_footer.tex",
-	"lemma_header.tex", "lemma_footer.tex",
-	"proof_header.tex", "proof_footer.tex",
-	"proposition_header.tex", "proposition_footer.tex",
-	"remark_header.tex", "remark_footer.tex",
-	"theorem_header.tex", "theorem_footer.tex"}
-
-// Check whether a given scroll has to be recompiled
-func IsUpToDate(id ID) bool {
-	if templatesModTime == -1 {
-		// Check template for modification times
-		templatesModTime = 0
-		foo, err := getModTime(os.Args[0])
-		if err != nil && foo > templatesModTime {
-			templatesModTime = foo
-		}
+	return "." + l.config.ImageFormat
+}
+
+// CacheFile returns the path of the file in the cache directory with the name
+// of the given scroll and the given extension, e.g. the file the scroll is
+// rendered to.
+func (l *Library) CacheFile(id ID, extension string) string {
+	return l.config.CacheDirectory + string(id) + extension
+}
+
+// PageFile returns the path of the file the given page of a scroll spanning
+// several pages is rendered to, counting from 0, e.g. id-0.png.
+func (l *Library) PageFile(id ID, page int, extension string) string {
+	return l.CacheFile(id, "-"+strconv.Itoa(page)+extension)
+}
 
-		for _, file := range templateFiles {
-			foo, err := getModTime(Config.TemplateDirectory + file)
-			if err != nil {
-				break
-			}
-			if foo > templatesModTime {
-				templatesModTime = foo
-			}
+// Find the files in the cache directory the scroll was rendered to in the
+// format with the given extension.  That is either a single file, or one file
+// per page.
+func (l *Library) renderedPages(id ID, extension string) []string {
+	path := l.CacheFile(id, extension)
+	if _, err := os.Stat(path); err == nil {
+		return []string{path}
+	}
+	var pages []string
+	for page := 0; ; page++ {
+		path := l.PageFile(id, page, extension)
+		if _, err := os.Stat(path); err != nil {
+			return pages
 		}
+		pages = append(pages, path)
 	}
+}
 
-	info, err := os.Stat(Config.CacheDirectory + string(id) + ".png")
-	if err != nil {
-		return false
+// RenderedFiles returns the paths of the files in the cache directory the
+// given scroll was rendered to, in order.  Usually, there is just one, but a
+// scroll spanning several pages is rendered to one image per page.  Files in
+// the currently configured format take precedence over any others that might
+// be left over from before the format was changed.  The scroll may belong to
+// any of the libraries searched together with this one.
+func (l *Library) RenderedFiles(id ID) []string {
+	if library, localID := l.resolveID(id); library != l {
+		return library.RenderedFiles(localID)
+	}
+	extensions := append([]string{l.preferredExtension()}, renderedExtensions...)
+	for _, extension := range extensions {
+		if pages := l.renderedPages(id, extension); len(pages) > 0 {
+			return pages
+		}
 	}
-	imageTime := info.ModTime().Unix()
+	return nil
+}
 
-	if imageTime < templatesModTime {
-		return false
+// RenderedFile returns the path of the (first) file in the cache directory
+// the given scroll was rendered to, or the empty string if there is no such
+// file.
+func (l *Library) RenderedFile(id ID) string {
+	if files := l.RenderedFiles(id); len(files) > 0 {
+		return files[0]
 	}
+	return ""
+}
 
-	info, err = os.Stat(Config.KnowledgeDirectory + string(id) + ".tex")
-	if err != nil {
-		return false // When in doubt, recompile
+// ClearRenderedFiles deletes the files the given scroll was rendered to in
+// the format with the given extension, so that none of them are left over if
+// the number of pages changes.
+func (l *Library) ClearRenderedFiles(id ID, extension string) {
+	for _, path := range l.renderedPages(id, extension) {
+		TryLogError(os.Remove(path))
 	}
-	scrollTime := info.ModTime().Unix()
+}
 
-	return imageTime > scrollTime
+// Delete all the files a given scroll was rendered to from the cache.
+func (l *Library) removeRenderedFiles(id ID) {
+	for _, extension := range renderedExtensions {
+		l.ClearRenderedFiles(id, extension)
+	}
+	err := os.Remove(l.cacheKeyFile(id))
+	if !os.IsNotExist(err) {
+		TryLogError(err)
+	}
+	l.ClearFailure(id)
 }
@@ -0,0 +1,70 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package common
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// How long WatchLibrary waits for further changes before updating the index.
+// Editors often write a file in several steps, e.g. by writing a temporary
+// file and renaming it, and each of them causes an event.
+const watchDelay = 500 * time.Millisecond
+
+// Watch watches the knowledge directory for scrolls being created, modified or
+// deleted, and updates the index accordingly.  Changes are collected until
+// none have occurred for a moment, then the affected scrolls are passed to
+// UpdateScrolls, and the result to onUpdate.  Watching stops when the context
+// is cancelled.
+func (l *Library) Watch(ctx context.Context, onUpdate func(IndexUpdate, error)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "create watcher")
+	}
+	defer watcher.Close()
+	err = watcher.Add(l.config.KnowledgeDirectory)
+	if err != nil {
+		return errors.Wrap(err, "watch knowledge directory")
+	}
+
+	changed := make(map[ID]bool)
+	var delay <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			id, _, ok := l.splitScrollFileName(filepath.Base(event.Name))
+			if !ok {
+				// Ignore swap files and the like.
+				continue
+			}
+			changed[id] = true
+			delay = time.After(watchDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			LogError(errors.Wrap(err, "watch knowledge directory"))
+		case <-delay:
+			delay = nil
+			ids := make([]ID, 0, len(changed))
+			for id := range changed {
+				ids = append(ids, id)
+			}
+			changed = make(map[ID]bool)
+			onUpdate(l.UpdateScrolls(ids))
+		}
+	}
+}
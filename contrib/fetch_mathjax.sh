@@ -0,0 +1,32 @@
+#!/bin/sh
+# This file is part of Alexandria which is released under AGPLv3.
+# Copyright (C) 2015-2018 Colin Benner
+# See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+# license details.
+
+# Download MathJax into templates/static/mathjax, so that it is embedded in the
+# assets and served by alexandria-web itself rather than loaded from a CDN.
+# Only the component used by the search page and its fonts are kept, together
+# with MathJax's LICENSE.  `go generate` in common runs this before embedding
+# the assets.  Nothing is downloaded if the copy is already up to date.
+
+set -e
+
+version=3.2.2
+dir="$(dirname "$0")/../templates/static/mathjax"
+
+if [ "$(cat "$dir/VERSION" 2>/dev/null)" = "$version" ]; then
+	exit 0
+fi
+
+tmp="$(mktemp -d)"
+trap 'rm -rf "$tmp"' EXIT
+
+curl -sSfL -o "$tmp/mathjax.tgz" "https://registry.npmjs.org/mathjax/-/mathjax-$version.tgz"
+tar -xzf "$tmp/mathjax.tgz" -C "$tmp"
+
+rm -rf "$dir"
+mkdir -p "$dir/output/chtml/fonts"
+cp "$tmp/package/LICENSE" "$tmp/package/es5/tex-chtml.js" "$dir/"
+cp -r "$tmp/package/es5/output/chtml/fonts/woff-v2" "$dir/output/chtml/fonts/"
+echo "$version" > "$dir/VERSION"
@@ -8,6 +8,7 @@ require (
 	github.com/blevesearch/bleve v1.0.14
 	github.com/blevesearch/mmap-go v1.0.4 // indirect
 	github.com/blevesearch/segment v0.9.1 // indirect
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/golang/protobuf v1.5.4 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
 	github.com/ogier/pflag v0.0.1
@@ -16,10 +17,12 @@ require (
 	github.com/shurcooL/httpfs v0.0.0-20230704072500-f1e31cf0ba5c // indirect
 	github.com/shurcooL/vfsgen v0.0.0-20230704071429-0000e147ea92
 	github.com/willf/bitset v1.13.0 // indirect
+	github.com/yuin/goldmark v1.4.13
 	go.etcd.io/bbolt v1.3.9 // indirect
 	golang.org/x/sys v0.19.0 // indirect
 	golang.org/x/tools v0.1.12 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 replace github.com/willf/bitset => github.com/bits-and-blooms/bitset v1.1.11
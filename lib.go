@@ -9,7 +9,10 @@
 package alexandria
 
 import (
+	"context"
+
 	"github.com/yzhs/alexandria/backends/latex"
+	"github.com/yzhs/alexandria/backends/markdown"
 	"github.com/yzhs/alexandria/common"
 )
 
@@ -27,33 +30,152 @@ const (
 )
 
 type (
-	Backend    = common.Backend
-	ID         = common.ID
-	Scroll     = common.Scroll
-	Statistics = common.Statistics
+	Backend        = common.Backend
+	BackendFactory = common.BackendFactory
+	CheckReport    = common.CheckReport
+	Configuration  = common.Configuration
+	GarbageReport  = common.GarbageReport
+	ID             = common.ID
+	IndexUpdate    = common.IndexUpdate
+	Library        = common.Library
+	RenderError    = common.RenderError
+	RenderWarning  = common.RenderWarning
+	Scroll         = common.Scroll
+	Statistics     = common.Statistics
 )
 
 var (
 	Assets = common.Assets
-	Config = common.Config
+	// Config is the configuration of the default library.  Changes only
+	// take effect if they are made before the default library is first
+	// used.
+	Config = &common.Config
 )
 
+func newBackend(t scrollType, l *Library) common.Backend {
+	switch t {
+	case markdownScroll:
+		return markdown.MarkdownToHTMLBackend{Library: l}
+	case latexScroll:
+		if l.Config().RenderLatexToHTML || !latex.IsTexInstalled(l.Config().Renderer) {
+			return latex.LatexToHTMLBackend{Library: l}
+		}
+		fallthrough
+	default:
+		return latex.LatexToPngBackend{Library: l, NewRenderer: latex.NewRenderer}
+	}
+}
+
+func init() {
+	common.RegisterBackend(".tex", func(l *Library) common.Backend {
+		return newBackend(latexScroll, l)
+	})
+	common.RegisterBackend(".md", func(l *Library) common.Backend {
+		return newBackend(markdownScroll, l)
+	})
+}
+
+// DefaultDirectory returns the directory the library is stored in unless
+// another one is chosen explicitly.
+func DefaultDirectory() string {
+	return common.DefaultDirectory()
+}
+
+// NewConfiguration returns the default configuration of a library stored in
+// the given directory.
+func NewConfiguration(dir string) Configuration {
+	return common.NewConfiguration(dir)
+}
+
+// LoadConfiguration applies the settings from the given configuration file and
+// the environment to config.
+func LoadConfiguration(config Configuration, file string) (Configuration, error) {
+	return common.LoadConfiguration(config, file)
+}
+
+// NewLibrary creates a library with the given configuration, independent of
+// the default library and any other library.
+func NewLibrary(config Configuration) *Library {
+	return common.NewLibrary(config)
+}
+
+// DefaultLibrary returns the library described by Config.  The functions below
+// all operate on it.
+func DefaultLibrary() *Library {
+	return common.DefaultLibrary()
+}
+
+// NewBackend returns a backend handling all supported scroll formats, passing
+// each scroll on to the backend for its file extension.
 func NewBackend() common.Backend {
-	return latex.LatexToPngBackend{Renderer: &latex.XelatexImagemagickRenderer{}}
+	return DefaultLibrary()
 }
 
 func LoadScrolls(ids []ID) ([]common.Scroll, error) {
-	return common.LoadScrolls(NewBackend(), ids)
+	return DefaultLibrary().LoadScrolls(ids)
+}
+
+// IsRenderWarning checks whether an error returned by a backend is merely a
+// warning, i.e. the scroll was rendered nonetheless.
+func IsRenderWarning(err error) bool {
+	return common.IsRenderWarning(err)
 }
 
-func UpdateIndex() error {
-	return common.UpdateIndex(NewBackend())
+// IsRenderTimeout checks whether an error returned by a backend was caused by
+// a scroll taking longer than Config.RenderTimeout to render.
+func IsRenderTimeout(err error) bool {
+	return common.IsRenderTimeout(err)
+}
+
+// RenderedFile returns the path of the file a scroll was rendered to.
+func RenderedFile(id ID) string {
+	return DefaultLibrary().RenderedFile(id)
+}
+
+// RenderedFiles returns the paths of all the files a scroll was rendered to,
+// i.e. one per page for scrolls spanning several pages.
+func RenderedFiles(id ID) []string {
+	return DefaultLibrary().RenderedFiles(id)
+}
+
+// OpenLibrary opens the index of the default library and keeps it open until
+// the library is closed.  Meanwhile, the other functions accessing the index
+// use the open index.
+func OpenLibrary() (*Library, error) {
+	l := DefaultLibrary()
+	return l, l.Open()
+}
+
+func UpdateIndex() (IndexUpdate, error) {
+	return DefaultLibrary().UpdateIndex()
+}
+
+// UpdateScrolls brings the index up to date with the given scrolls only.
+func UpdateScrolls(ids []ID) (IndexUpdate, error) {
+	return DefaultLibrary().UpdateScrolls(ids)
+}
+
+// WatchLibrary keeps the index up to date with the library until the context
+// is cancelled, calling onUpdate after each change to the index.
+func WatchLibrary(ctx context.Context, onUpdate func(IndexUpdate, error)) error {
+	return DefaultLibrary().Watch(ctx, onUpdate)
 }
 
 func FindMatchingScrolls(query string) ([]ID, int, error) {
-	return common.FindMatchingScrolls(query)
+	return DefaultLibrary().FindMatchingScrolls(query)
+}
+
+// CheckLibrary validates the metadata of all scrolls and compiles them.
+func CheckLibrary(ctx context.Context) (CheckReport, error) {
+	return DefaultLibrary().Check(ctx)
+}
+
+// CollectGarbage deletes the rendered files of scrolls that no longer exist and
+// stale temporary files.
+func CollectGarbage() (GarbageReport, error) {
+	return DefaultLibrary().CollectGarbage()
 }
 
 func ComputeStatistics() (Statistics, error) {
-	return common.ComputeStatistics()
+	return DefaultLibrary().ComputeStatistics()
 }